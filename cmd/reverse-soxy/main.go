@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,6 +20,11 @@ import (
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
+
 	// Debug flag
 	debugFlag := flag.Bool("debug", false, "enable debug logging")
 
@@ -32,7 +39,36 @@ func main() {
 	retryFlag := flag.Int("retry", 10, "Maximum number of retries")
 	registerFlag := flag.Bool("register", false, "Proxy registers its availability to Relay server")
 	relayAddr := flag.String("relay-addr", "", "Relay server address (IP:port) for registration or agent dialing")
+	identityFlag := flag.String("identity", "", "Ed25519 private key file identifying this proxy or agent (see keygen)")
+	authorizedAgentsFlag := flag.String("authorized-agents", "", "File of \"<name> <public key>\" lines allowed to connect (proxy mode)")
+	proxyKeyFlag := flag.String("proxy-key", "", "Public key the proxy must authenticate with (agent mode)")
+	transportFlag := flag.String("transport", "tcp", "Tunnel and relay transport: tcp or tls")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (required to listen with --transport tls; client certificate for mTLS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file for --tls-cert")
+	tlsCA := flag.String("tls-ca", "", "CA bundle to verify the TLS peer instead of the system roots")
+	tlsClientAuth := flag.Bool("tls-client-auth", false, "Require and verify TLS client certificates (mTLS) on listeners")
+	tlsPin := flag.String("tls-pin", "", "Hex SHA-256 fingerprint the TLS peer certificate must match")
+	tlsServerName := flag.String("tls-server-name", "", "Server name to verify when dialing over TLS")
+	socksAuthFile := flag.String("socks-auth-file", "", "htpasswd-style file of SOCKS5 users (enables username/password auth)")
+	httpAddr := flag.String("http-listen-addr", "", "HTTP proxy (CONNECT and forward) listen address; disabled when empty")
+	dnsListenAddr := flag.String("dns-listen-addr", "", "DNS server (UDP and TCP) answering through the agent; disabled when empty")
+	dnsServer := flag.String("dns-server", "", "DNS server the agent forwards queries to (default: its system nameservers)")
+	pacListenAddr := flag.String("pac-listen-addr", "", "Serve a PAC file built from the config's pac_rules (or routes) on this address; disabled when empty")
+	pacProxyAddr := flag.String("pac-proxy-addr", "", "SOCKS address the PAC file points browsers to (default: the listener, with the PAC request's host)")
+	var forwardFlags stringList
+	flag.Var(&forwardFlags, "forward", "Static forward local=remote[@agent]: listen on local (address or port) and tunnel to remote via the agent; repeatable")
+	var reverseFlags stringList
+	flag.Var(&reverseFlags, "reverse-forward", "Reverse forward remote=local[@agent]: the agent listens on remote (address or port) and the proxy dials local; repeatable")
+	agentNameFlag := flag.String("agent-name", "", "Name this agent reports to the proxy (default hostname; agent mode)")
+	agentGroupFlag := flag.String("agent-group", "", "Group this agent joins, for agents that serve the same network (agent mode)")
+	defaultAgentFlag := flag.String("default-agent", "", "Agent or group that handles sessions not routed to a named agent (default: the most recently connected)")
+	balanceFlag := flag.String("balance", "round-robin", "How sessions for a group are spread over its agents: round-robin, least-sessions or lowest-latency")
+	transparentAddr := flag.String("transparent-listen-addr", "", "Listen address for iptables/nftables REDIRECT traffic (Linux only); disabled when empty")
 	flag.Parse()
+	var socksUsers map[string]string
+	var forwards, reverseForwards []proxy.Forward
+	var pacRules []proxy.PACRule
+	var routes []proxy.Route
 
 	// graceful shutdown on SIGINT/SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -50,13 +86,39 @@ func main() {
 			logger.Fatalf("Failed to read config: %v", err)
 		}
 		var cfg struct {
-			SocksListenAddr  string `yaml:"socks_listen_addr"`
-			TunnelListenPort int    `yaml:"tunnel_listen_port"`
-			TunnelAddr       string `yaml:"tunnel_addr"`
-			MaxRetries       int    `yaml:"max_retries"`
-			Secret           string `yaml:"secret"`
-			RelayListenPort  int    `yaml:"relay_listen_port"`
-			RelayAddr        string `yaml:"relay_addr"`
+			SocksListenAddr  string            `yaml:"socks_listen_addr"`
+			TunnelListenPort int               `yaml:"tunnel_listen_port"`
+			TunnelAddr       string            `yaml:"tunnel_addr"`
+			MaxRetries       int               `yaml:"max_retries"`
+			Secret           string            `yaml:"secret"`
+			RelayListenPort  int               `yaml:"relay_listen_port"`
+			RelayAddr        string            `yaml:"relay_addr"`
+			IdentityFile     string            `yaml:"identity_file"`
+			AuthorizedAgents string            `yaml:"authorized_agents_file"`
+			ProxyPublicKey   string            `yaml:"proxy_public_key"`
+			Transport        string            `yaml:"transport"`
+			TLSCertFile      string            `yaml:"tls_cert_file"`
+			TLSKeyFile       string            `yaml:"tls_key_file"`
+			TLSCAFile        string            `yaml:"tls_ca_file"`
+			TLSClientAuth    bool              `yaml:"tls_client_auth"`
+			TLSPinSHA256     string            `yaml:"tls_pin_sha256"`
+			TLSServerName    string            `yaml:"tls_server_name"`
+			SocksAuthFile    string            `yaml:"socks_auth_file"`
+			SocksUsers       map[string]string `yaml:"socks_users"`
+			HTTPListenAddr   string            `yaml:"http_listen_addr"`
+			TransparentAddr  string            `yaml:"transparent_listen_addr"`
+			DNSListenAddr    string            `yaml:"dns_listen_addr"`
+			DNSServer        string            `yaml:"dns_server"`
+			PACListenAddr    string            `yaml:"pac_listen_addr"`
+			PACProxyAddr     string            `yaml:"pac_proxy_addr"`
+			PACRules         []proxy.PACRule   `yaml:"pac_rules"`
+			Forwards         []proxy.Forward   `yaml:"forwards"`
+			ReverseForwards  []proxy.Forward   `yaml:"reverse_forwards"`
+			AgentName        string            `yaml:"agent_name"`
+			AgentGroup       string            `yaml:"agent_group"`
+			DefaultAgent     string            `yaml:"default_agent"`
+			Balance          string            `yaml:"balance"`
+			Routes           []proxy.Route     `yaml:"routes"`
 		}
 		if err := yaml.Unmarshal(data, &cfg); err != nil {
 			logger.Fatalf("Failed to parse config: %v", err)
@@ -84,6 +146,74 @@ func main() {
 		if *retryFlag == 10 && cfg.MaxRetries != 0 {
 			*retryFlag = cfg.MaxRetries
 		}
+		if *identityFlag == "" && cfg.IdentityFile != "" {
+			*identityFlag = cfg.IdentityFile
+		}
+		if *authorizedAgentsFlag == "" && cfg.AuthorizedAgents != "" {
+			*authorizedAgentsFlag = cfg.AuthorizedAgents
+		}
+		if *proxyKeyFlag == "" && cfg.ProxyPublicKey != "" {
+			*proxyKeyFlag = cfg.ProxyPublicKey
+		}
+		if *transportFlag == "tcp" && cfg.Transport != "" {
+			*transportFlag = cfg.Transport
+		}
+		if *tlsCert == "" && cfg.TLSCertFile != "" {
+			*tlsCert = cfg.TLSCertFile
+		}
+		if *tlsKey == "" && cfg.TLSKeyFile != "" {
+			*tlsKey = cfg.TLSKeyFile
+		}
+		if *tlsCA == "" && cfg.TLSCAFile != "" {
+			*tlsCA = cfg.TLSCAFile
+		}
+		if !*tlsClientAuth && cfg.TLSClientAuth {
+			*tlsClientAuth = true
+		}
+		if *tlsPin == "" && cfg.TLSPinSHA256 != "" {
+			*tlsPin = cfg.TLSPinSHA256
+		}
+		if *tlsServerName == "" && cfg.TLSServerName != "" {
+			*tlsServerName = cfg.TLSServerName
+		}
+		if *socksAuthFile == "" && cfg.SocksAuthFile != "" {
+			*socksAuthFile = cfg.SocksAuthFile
+		}
+		if *httpAddr == "" && cfg.HTTPListenAddr != "" {
+			*httpAddr = cfg.HTTPListenAddr
+		}
+		if *transparentAddr == "" && cfg.TransparentAddr != "" {
+			*transparentAddr = cfg.TransparentAddr
+		}
+		if *dnsListenAddr == "" && cfg.DNSListenAddr != "" {
+			*dnsListenAddr = cfg.DNSListenAddr
+		}
+		if *dnsServer == "" && cfg.DNSServer != "" {
+			*dnsServer = cfg.DNSServer
+		}
+		if *pacListenAddr == "" && cfg.PACListenAddr != "" {
+			*pacListenAddr = cfg.PACListenAddr
+		}
+		if *pacProxyAddr == "" && cfg.PACProxyAddr != "" {
+			*pacProxyAddr = cfg.PACProxyAddr
+		}
+		if *agentNameFlag == "" && cfg.AgentName != "" {
+			*agentNameFlag = cfg.AgentName
+		}
+		if *agentGroupFlag == "" && cfg.AgentGroup != "" {
+			*agentGroupFlag = cfg.AgentGroup
+		}
+		if *defaultAgentFlag == "" && cfg.DefaultAgent != "" {
+			*defaultAgentFlag = cfg.DefaultAgent
+		}
+		if *balanceFlag == "round-robin" && cfg.Balance != "" {
+			*balanceFlag = cfg.Balance
+		}
+		pacRules = cfg.PACRules
+		routes = cfg.Routes
+		socksUsers = cfg.SocksUsers
+		forwards = cfg.Forwards
+		reverseForwards = cfg.ReverseForwards
 
 		logger.Debug("Loaded config from %s: socks_listen_addr=%s, tunnel_listen_port=%d, tunnel_addr=%s, secret=%s, relay_listen_port=%d, relay_addr=%s, max_retries=%d",
 			*cfgPath,
@@ -96,9 +226,121 @@ func main() {
 			cfg.MaxRetries)
 	}
 
-	// ensure shared secret is provided
-	if *secretFlag == "" {
-		logger.Fatal("Shared secret required: use -secret flag or config")
+	// public-key authentication
+	if *identityFlag != "" {
+		key, err := proxy.LoadIdentity(*identityFlag)
+		if err != nil {
+			logger.Fatalf("Failed to load identity: %v", err)
+		}
+		proxy.SetIdentity(key)
+	}
+	if *authorizedAgentsFlag != "" {
+		if _, err := os.Stat(*authorizedAgentsFlag); err != nil {
+			logger.Fatalf("Invalid authorized-agents file: %v", err)
+		}
+		proxy.SetAuthorizedAgents(*authorizedAgentsFlag)
+	}
+	if *proxyKeyFlag != "" {
+		pub, err := proxy.ParsePublicKey(*proxyKeyFlag)
+		if err != nil {
+			logger.Fatalf("Invalid proxy-key: %v", err)
+		}
+		proxy.SetProxyPublicKey(pub)
+	}
+
+	// transport
+	switch *transportFlag {
+	case "tcp":
+	case "tls":
+		if *tlsClientAuth && *tlsCA == "" && *tlsPin == "" {
+			logger.Fatal("--tls-client-auth requires --tls-ca or --tls-pin to verify client certificates")
+		}
+		proxy.SetTLS(proxy.TLSOptions{
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			CAFile:     *tlsCA,
+			ClientAuth: *tlsClientAuth,
+			PinSHA256:  *tlsPin,
+			ServerName: *tlsServerName,
+		})
+	default:
+		logger.Fatalf("Invalid transport %q: use tcp or tls", *transportFlag)
+	}
+
+	// SOCKS5 username/password authentication
+	if *socksAuthFile != "" {
+		fileUsers, err := proxy.LoadHtpasswd(*socksAuthFile)
+		if err != nil {
+			logger.Fatalf("Failed to load socks-auth-file: %v", err)
+		}
+		if socksUsers == nil {
+			socksUsers = make(map[string]string)
+		}
+		for user, password := range fileUsers {
+			socksUsers[user] = password
+		}
+	}
+	if len(socksUsers) > 0 {
+		proxy.SetSOCKSCredentials(socksUsers)
+	}
+
+	if *httpAddr != "" {
+		proxy.SetHTTPListenAddr(*httpAddr)
+	}
+	if *transparentAddr != "" {
+		proxy.SetTransparentListenAddr(*transparentAddr)
+	}
+	if *dnsListenAddr != "" {
+		proxy.SetDNSListenAddr(*dnsListenAddr)
+	}
+	if *dnsServer != "" {
+		proxy.SetDNSServer(*dnsServer)
+	}
+	if *pacListenAddr != "" {
+		if err := proxy.SetPAC(*pacListenAddr, *pacProxyAddr, pacRules); err != nil {
+			logger.Fatalf("Invalid PAC configuration: %v", err)
+		}
+	}
+
+	// multiple agents
+	if *agentNameFlag != "" {
+		proxy.SetAgentName(*agentNameFlag)
+	}
+	if *agentGroupFlag != "" {
+		proxy.SetAgentGroup(*agentGroupFlag)
+	}
+	if *defaultAgentFlag != "" {
+		proxy.SetDefaultAgent(*defaultAgentFlag)
+	}
+	if err := proxy.SetBalance(*balanceFlag); err != nil {
+		logger.Fatal(err)
+	}
+	if err := proxy.SetRoutes(routes); err != nil {
+		logger.Fatalf("Invalid routes: %v", err)
+	}
+
+	// static and reverse port forwards: flags add to the config file's lists
+	for _, spec := range forwardFlags {
+		f, err := proxy.ParseForward(spec)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		forwards = append(forwards, f)
+	}
+	proxy.SetForwards(forwards)
+	for _, spec := range reverseFlags {
+		f, err := proxy.ParseReverseForward(spec)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		reverseForwards = append(reverseForwards, f)
+	}
+	proxy.SetReverseForwards(reverseForwards)
+
+	// ensure shared secret is provided unless both directions use keys
+	keyAuth := *identityFlag != "" && (*authorizedAgentsFlag != "" || *proxyKeyFlag != "")
+	if *secretFlag == "" && !keyAuth && *modeFlag != "relay" {
+		logger.Fatal("Shared secret required: use -secret flag or config, or -identity with -authorized-agents/-proxy-key")
 	}
 
 	// validate tunnelAddr if provided
@@ -123,7 +365,7 @@ func main() {
 	logger.Info("Debug logging enabled: %v", *debugFlag)
 
 	// Dispatch
-	logger.Debug("CLI flags: proxy-listen-addr=%s, tunnel-listen-port=%d, tunnel-addr=%s, secret=%s, config=%s, mode=%s, relay-listen-port=%d, register=%v, relay-addr=%s", *socksAddr, *tunnelPort, *tunnelAddr, *secretFlag, *cfgPath, *modeFlag, *relayListenPort, *registerFlag, *relayAddr)
+	logger.Debug("CLI flags: proxy-listen-addr=%s, tunnel-listen-port=%d, tunnel-addr=%s, secret=%s, config=%s, mode=%s, relay-listen-port=%d, register=%v, relay-addr=%s, identity=%s, authorized-agents=%s, proxy-key=%s, transport=%s", *socksAddr, *tunnelPort, *tunnelAddr, *secretFlag, *cfgPath, *modeFlag, *relayListenPort, *registerFlag, *relayAddr, *identityFlag, *authorizedAgentsFlag, *proxyKeyFlag, *transportFlag)
 	if *modeFlag == "relay" {
 		proxy.RunRelay(*relayListenPort, *secretFlag)
 	} else if *registerFlag {
@@ -139,3 +381,37 @@ func main() {
 		proxy.RunProxy(*socksAddr, *tunnelPort, *secretFlag)
 	}
 }
+
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runKeygen implements the keygen subcommand: it writes a new Ed25519 identity and
+// prints the line to add to the proxy's authorized-agents file
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "agent.key", "private key output file")
+	name := fs.String("name", "", "agent name for the authorized-agents line (default hostname)")
+	fs.Parse(args)
+	if *name == "" {
+		*name, _ = os.Hostname()
+	}
+	if _, err := os.Stat(*out); err == nil {
+		logger.Fatalf("Refusing to overwrite existing key file %s", *out)
+	}
+	pub, err := proxy.GenerateIdentity(*out)
+	if err != nil {
+		logger.Fatalf("Key generation failed: %v", err)
+	}
+	fmt.Printf("Private key written to %s\n", *out)
+	fmt.Printf("Public key: %s\n", pub)
+	fmt.Printf("authorized-agents line:\n%s %s\n", *name, pub)
+}
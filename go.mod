@@ -1,14 +1,15 @@
 module github.com/lonepie/reverse-soxy
 
-go 1.24
+go 1.24.0
 
 require (
 	github.com/fatih/color v1.13.0
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.9 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 )
@@ -1,25 +1,15 @@
 package proxy
 
 import (
-	"encoding/binary"
-	"io"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/lonepie/reverse-soxy/internal/logger"
 )
 
-type session struct {
-	targetConn net.Conn
-	incoming   chan []byte
-	ready      chan struct{}
-}
-
-var (
-	sessionsMu  sync.Mutex
-	sessionsMap = make(map[uint32]*session)
-)
+// dialTimeout bounds how long the agent, or the proxy for direct routes, tries to
+// reach a session target
+const dialTimeout = 15 * time.Second
 
 // DefaultMaxRetries is the default number of times to retry connecting before giving up
 const DefaultMaxRetries = 10
@@ -34,7 +24,7 @@ func RunAgentRelay(relayAddr, secret string, maxRetries int) {
 	retryCount := 0
 
 	for {
-		rawConn, err := net.Dial("tcp", relayAddr)
+		rawConn, err := dialTunnel(relayAddr)
 		if err != nil {
 			retryCount++
 			logger.Error("AgentRelay dial failed: %v (attempt %d/%d)", err, retryCount, maxRetries)
@@ -81,7 +71,7 @@ func RunAgent(proxyAddr, secret string, maxRetries int) {
 
 	// continuously dial and maintain tunnel
 	for retryCount < maxRetries {
-		rawConn, err := net.Dial("tcp", proxyAddr)
+		rawConn, err := dialTunnel(proxyAddr)
 		if err != nil {
 			retryCount++
 			logger.Error("Agent connection failed: %v (attempt %d/%d)", err, retryCount, maxRetries)
@@ -97,12 +87,6 @@ func RunAgent(proxyAddr, secret string, maxRetries int) {
 
 		// Reset retry counter on successful connection
 		retryCount = 0
-		// TCP optimizations
-		if tcpConn, ok := rawConn.(*net.TCPConn); ok {
-			tcpConn.SetNoDelay(true)
-			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(30 * time.Second)
-		}
 		// secure handshake
 		secureConn, err := NewSecureClientConn(rawConn, secret)
 		if err != nil {
@@ -129,120 +113,69 @@ func RunAgent(proxyAddr, secret string, maxRetries int) {
 	}
 }
 
-func handleTunnelReadsServer(tunnel net.Conn) {
+// handleTunnelReadsServer serves the agent end of a tunnel until it fails
+func handleTunnelReadsServer(conn net.Conn) {
 	logger.Info("Starting to read from tunnel")
-	for {
-		logger.Debug("Waiting for tunnel header...")
-		header := make([]byte, 6)
-		_, err := io.ReadFull(tunnel, header)
-		if err != nil {
-			logger.Info("tunnel read error:", err)
-			return
-		}
-		sessID := binary.BigEndian.Uint32(header[:4])
-		logger.Debug("Read header - session ID: %08x", sessID)
-		length := binary.BigEndian.Uint16(header[4:6])
-		logger.Debug("Expected payload length: %d", length)
-
-		sessionsMu.Lock()
-		sess, ok := sessionsMap[sessID]
-		sessionsMu.Unlock()
-		if !ok {
-			// First message for this session: target string
-			targetBuf := make([]byte, length)
-			_, err = io.ReadFull(tunnel, targetBuf)
-			if err != nil {
-				logger.Error("Failed to read target address: %v", err)
-				continue
-			}
-			target := string(targetBuf)
-			logger.Info("session %08x connecting to %s", sessID, target)
-
-			tgtConn, err := net.Dial("tcp", target)
-			if err != nil {
-				logger.Error("session %08x dial failed: %v", sessID, err)
-				continue
-			}
-			sess = &session{
-				targetConn: tgtConn,
-				incoming:   make(chan []byte, 10),
-				ready:      make(chan struct{}),
-			}
-			sessionsMu.Lock()
-			sessionsMap[sessID] = sess
-			sessionsMu.Unlock()
-			close(sess.ready)
-			go handleSession(sessID, sess, tunnel)
-			continue // go to next header, do not expect payload for this header
-		}
-
-		// Existing session: treat as payload
-		select {
-		case <-sess.ready:
-			logger.Debug("session %08x is ready to receive payload", sessID)
-		case <-time.After(2 * time.Second):
-			logger.Debug("session %08x timed out waiting for ready", sessID)
-			continue
-		}
-
-		logger.Debug("about to read %d bytes of payload for session %08x", length, sessID)
-		buf := make([]byte, length)
-		bytesRead := 0
-		for bytesRead < int(length) {
-			n, err := tunnel.Read(buf[bytesRead:])
-			logger.Debug("Read returned %d bytes, err=%v", n, err)
-			logger.Debug("Bytes read so far (%d/%d): %x", bytesRead+n, length, buf[:bytesRead+n])
-			if n > 0 {
-				bytesRead += n
+	t := newTunnel(conn)
+	// introduce ourselves before anything else goes out
+	if err := t.send(frameHello, 0, helloPayload()); err != nil {
+		logger.Error("Failed to send hello: %v", err)
+		t.close()
+		return
+	}
+	go t.keepalive()
+	err := t.readLoop(func(t *tunnel, f frame) {
+		switch f.typ {
+		case frameOpen:
+			if len(f.payload) == 0 {
+				t.send(frameOpenResult, f.sessID, append([]byte{socksRepGeneralFailure}, encodeSOCKSAddr(nil)...))
+				break
 			}
-			if err != nil {
-				logger.Error("session %08x payload read error after %d bytes: %v", sessID, bytesRead, err)
-				return
+			switch cmd, target := f.payload[0], string(f.payload[1:]); cmd {
+			case openConnect:
+				go openSession(t, f.sessID, target)
+			case openBind:
+				go openBindSession(t, f.sessID, target)
+			case openUDPAssociate:
+				go openUDPAssociation(t, f.sessID)
+			case openListen:
+				go openReverseListener(t, f.sessID, target)
+			case openDNS, openDNSTCP:
+				go forwardDNS(t, f.sessID, f.payload[1:], cmd == openDNSTCP)
+			case openResolve, openResolvePTR:
+				go resolveForProxy(t, f.sessID, cmd, target)
+			default:
+				logger.Error("session %08x unsupported open command %#02x", f.sessID, cmd)
+				t.send(frameOpenResult, f.sessID, append([]byte{socksRepCmdNotSupported}, encodeSOCKSAddr(nil)...))
 			}
+		default:
+			logger.Error("Unexpected %s frame for session %08x", frameTypeName(f.typ), f.sessID)
 		}
-		logger.Debug("finished reading payload for session %08x", sessID)
-		logger.Debug("session %08x received %d bytes payload: %x", sessID, length, buf)
-		sess.incoming <- buf
-	}
+	})
+	logger.Info("tunnel read error: %v", err)
 }
 
-var serverTunnelWriteMu sync.Mutex
-
-func handleSession(sessID uint32, sess *session, tunnel net.Conn) {
-	defer sess.targetConn.Close()
-	defer func() {
-		sessionsMu.Lock()
-		delete(sessionsMap, sessID)
-		sessionsMu.Unlock()
-		close(sess.incoming)
-	}()
-
-	go func() {
-		buf := make([]byte, 4096)
-		header := make([]byte, 6)
-		binary.BigEndian.PutUint32(header[:4], sessID)
-		for {
-			n, err := sess.targetConn.Read(buf)
-			if err != nil {
-				logger.Debug("session %08x closed by target", sessID)
-				return
-			}
-			binary.BigEndian.PutUint16(header[4:], uint16(n))
-			serverTunnelWriteMu.Lock()
-			tunnel.Write(header)
-			tunnel.Write(buf[:n])
-			serverTunnelWriteMu.Unlock()
-			logger.Debug("session %08x sent %d bytes to tunnel, payload: %s", sessID, n, string(buf[:n]))
-		}
-	}()
-
-	for data := range sess.incoming {
-		logger.Debug("session %08x writing %d bytes to target", sessID, len(data))
-		n, err := sess.targetConn.Write(data)
-		if err != nil {
-			logger.Error("session %08x write to target failed: %v", sessID, err)
-			break
-		}
-		logger.Debug("session %08x forwarded %d bytes to target", sessID, n)
+// openSession dials target for the proxy and reports the result as frameOpenResult:
+// REP | ATYP | BND.ADDR | BND.PORT
+func openSession(t *tunnel, sessID uint32, target string) {
+	logger.Info("session %08x connecting to %s", sessID, target)
+	tgtConn, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		logger.Error("session %08x dial failed: %v", sessID, err)
+		t.send(frameOpenResult, sessID, append([]byte{dialErrorReply(err)}, encodeSOCKSAddr(nil)...))
+		return
+	}
+	// register before replying so data sent right after the result is not lost
+	sess := t.addSession(sessID, tgtConn)
+	if sess == nil {
+		tgtConn.Close()
+		return
+	}
+	result := append([]byte{socksRepSucceeded}, encodeSOCKSAddr(tgtConn.LocalAddr())...)
+	if err := t.send(frameOpenResult, sessID, result); err != nil {
+		logger.Error("session %08x failed to send connect result: %v", sessID, err)
+		sess.abort(false)
+		return
 	}
+	sess.start()
 }
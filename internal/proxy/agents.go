@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// agentName is the name this agent introduces itself with; agents that
+// authenticate with an identity key are named by the proxy's authorized-agents file
+var agentName string
+
+// SetAgentName sets the name this agent reports to the proxy
+func SetAgentName(name string) {
+	agentName = name
+}
+
+// agentGroup is the group this agent joins on the proxy, for agents that serve the
+// same network
+var agentGroup string
+
+// SetAgentGroup sets the group this agent reports to the proxy
+func SetAgentGroup(group string) {
+	agentGroup = group
+}
+
+// defaultAgent names the agent that handles sessions no one chose an agent for;
+// when empty, the most recently connected agent does
+var defaultAgent string
+
+// SetDefaultAgent routes sessions without a chosen agent to the agent or group
+// called name
+func SetDefaultAgent(name string) {
+	defaultAgent = name
+}
+
+// agentConn is an agent connected to the proxy
+type agentConn struct {
+	name      string
+	group     string
+	tunnel    *tunnel
+	connected time.Time
+}
+
+var (
+	agentsMu sync.Mutex
+	agents   = make(map[string]*agentConn)
+)
+
+// helloPayload builds the frameHello an agent sends first on a new tunnel:
+// "key=value" lines
+func helloPayload() []byte {
+	name := agentName
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	hello := "name=" + name + "\n"
+	if agentGroup != "" {
+		hello += "group=" + agentGroup + "\n"
+	}
+	return []byte(hello)
+}
+
+// readHello reads the agent's frameHello from a new tunnel connection
+func readHello(conn net.Conn) (map[string]string, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	f, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if f.typ != frameHello {
+		return nil, fmt.Errorf("expected HELLO, got %s frame", frameTypeName(f.typ))
+	}
+	hello := make(map[string]string)
+	for _, line := range strings.Split(string(f.payload), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			hello[key] = value
+		}
+	}
+	return hello, nil
+}
+
+// acceptAgent secures a new tunnel connection and registers the agent
+func acceptAgent(rawConn net.Conn) {
+	secureConn, err := NewSecureServerConn(rawConn, tunnelSecret)
+	if err != nil {
+		logger.Error("Secure handshake with %v failed: %v", rawConn.RemoteAddr(), err)
+		rawConn.Close()
+		return
+	}
+	name, group, err := identifyAgent(secureConn)
+	if err != nil {
+		logger.Error("Agent at %v did not introduce itself: %v", secureConn.RemoteAddr(), err)
+		secureConn.Close()
+		return
+	}
+	registerAgent(name, group, newTunnel(secureConn))
+}
+
+// identifyAgent reads the agent's frameHello from a secured tunnel connection and
+// returns the agent's name and group
+func identifyAgent(secureConn net.Conn) (string, string, error) {
+	hello, err := readHello(secureConn)
+	if err != nil {
+		return "", "", err
+	}
+	name := hello["name"]
+	if authorized := peerName(secureConn); authorized != "" {
+		// the authorized-agents file names identity-authenticated agents
+		if name != "" && name != authorized {
+			logger.Debug("Agent %q calls itself %q; using the authorized name", authorized, name)
+		}
+		name = authorized
+	}
+	if name == "" {
+		name = secureConn.RemoteAddr().String()
+	}
+	return name, hello["group"], nil
+}
+
+// registerAgent makes t the tunnel of the agent called name, closing any tunnel
+// the agent had before, and serves it until it fails. A name held by another
+// agent's healthy tunnel is not taken over; see replacesAgent.
+func registerAgent(name, group string, t *tunnel) {
+	a := &agentConn{name: name, group: group, tunnel: t, connected: time.Now()}
+	agentsMu.Lock()
+	old := agents[name]
+	if old != nil && !replacesAgent(old, t) {
+		agentsMu.Unlock()
+		logger.Error("Agent from %v claims the name %q held by the agent at %v; refusing it", t.conn.RemoteAddr(), name, old.tunnel.conn.RemoteAddr())
+		t.close()
+		return
+	}
+	agents[name] = a
+	agentsMu.Unlock()
+	if old != nil {
+		logger.Info("Agent %q reconnected, closing its previous tunnel", name)
+		old.tunnel.close()
+	}
+	if group != "" {
+		logger.Info("Agent %q of group %q connected from %v", name, group, t.conn.RemoteAddr())
+	} else {
+		logger.Info("Agent %q connected from %v", name, t.conn.RemoteAddr())
+	}
+	go t.keepalive()
+	go func() {
+		handleTunnelReadsClient(t)
+		agentsMu.Lock()
+		if agents[name] == a {
+			delete(agents, name)
+		}
+		agentsMu.Unlock()
+		logger.Info("Agent %q disconnected", name)
+	}()
+	requestReverseForwards(a)
+}
+
+// replacesAgent reports whether the new tunnel t may take over old's name: when
+// old's tunnel is no longer healthy, or t is the same agent reconnecting, i.e. it
+// proved the same identity key or, for shared-secret agents that all prove the
+// same thing, it comes from the same host
+func replacesAgent(old *agentConn, t *tunnel) bool {
+	if healthy, _, _ := old.tunnel.health(); !healthy {
+		return true
+	}
+	oldKey, newKey := peerKey(old.tunnel.conn), peerKey(t.conn)
+	if oldKey != nil || newKey != nil {
+		return oldKey != nil && oldKey.Equal(newKey)
+	}
+	return remoteHost(old.tunnel.conn) == remoteHost(t.conn)
+}
+
+// remoteHost returns the host part of conn's remote address
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// agentConnected reports whether an agent or group called name is connected
+func agentConnected(name string) bool {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	return agents[name] != nil || len(groupMembers(name)) > 0
+}
+
+// errNoAgent means no connected agent can take a session
+var errNoAgent = errors.New("no agent connected")
+
+// agentTunnel returns the tunnel of the agent called name, or of the default
+// agent when name is empty. A name that is not an agent's may be a group's; the
+// balancing strategy then picks one of its healthy agents.
+func agentTunnel(name string) (*tunnel, error) {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	if name == "" {
+		name = defaultAgent
+	}
+	if name != "" {
+		if a := agents[name]; a != nil {
+			return a.tunnel, nil
+		}
+		if members := groupMembers(name); len(members) > 0 {
+			a := pickAgent(name, members)
+			if a == nil {
+				return nil, fmt.Errorf("no agent of group %q is healthy", name)
+			}
+			return a.tunnel, nil
+		}
+		return nil, fmt.Errorf("agent %q is not connected", name)
+	}
+	var latest *agentConn
+	for _, a := range agents {
+		if latest == nil || a.connected.After(latest.connected) {
+			latest = a
+		}
+	}
+	if latest == nil {
+		return nil, errNoAgent
+	}
+	return latest.tunnel, nil
+}
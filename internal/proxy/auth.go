@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// socksCredentials maps usernames to stored passwords; when non-nil, SOCKS clients
+// must authenticate with username/password (RFC 1929)
+var socksCredentials map[string]string
+
+// SetSOCKSCredentials requires SOCKS clients to log in with one of users. Stored
+// passwords may be plain text, bcrypt hashes or htpasswd "{SHA}" digests.
+func SetSOCKSCredentials(users map[string]string) {
+	socksCredentials = users
+}
+
+// LoadHtpasswd reads "user:password" lines as written by htpasswd -B or -s; plain
+// text passwords are accepted too
+func LoadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, stored, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"user:password\"", path, lineNo)
+		}
+		if strings.HasPrefix(stored, "$apr1$") || strings.HasPrefix(stored, "$1$") {
+			return nil, fmt.Errorf("%s:%d: MD5 password hashes are not supported, use htpasswd -B", path, lineNo)
+		}
+		users[user] = stored
+	}
+	return users, scanner.Err()
+}
+
+// checkPassword compares password against a stored plain, bcrypt or {SHA} password
+func checkPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		digest := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(stored[len("{SHA}"):]), []byte(digest)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+// authenticate verifies a username and password against the configured credentials
+func authenticate(user, password string) bool {
+	stored, ok := socksCredentials[user]
+	if !ok {
+		// spend comparable time so unknown users are not distinguishable
+		checkPassword("", password)
+		return false
+	}
+	return checkPassword(stored, password)
+}
+
+// authenticateUser checks a proxy client's credentials and returns the agent or
+// group its username picks: "alice@site-b" logs in as alice and picks site-b, a
+// username that is valid as a whole picks none. Without configured credentials
+// any username and password are accepted, and a bare username that names a
+// connected agent or group ("site-b") picks it.
+func authenticateUser(user, password string) (string, bool) {
+	if socksCredentials == nil {
+		if i := strings.LastIndex(user, "@"); i >= 0 {
+			return user[i+1:], true
+		}
+		if agentConnected(user) {
+			return user, true
+		}
+		return "", true
+	}
+	if authenticate(user, password) {
+		return "", true
+	}
+	if i := strings.LastIndex(user, "@"); i > 0 && authenticate(user[:i], password) {
+		return user[i+1:], true
+	}
+	return "", false
+}
+
+// socksUserPassAuth runs the RFC 1929 sub-negotiation after method 0x02 was selected
+// and returns the agent the username picks, if any
+func socksUserPassAuth(client net.Conn) (string, bool) {
+	// VER | ULEN | UNAME | PLEN | PASSWD
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(client, hdr); err != nil {
+		logger.Error("SOCKS auth read failed: %v", err)
+		return "", false
+	}
+	if hdr[0] != 0x01 {
+		logger.Error("Unsupported SOCKS auth version: %v", hdr[0])
+		return "", false
+	}
+	user := make([]byte, int(hdr[1])+1)
+	if _, err := io.ReadFull(client, user); err != nil {
+		logger.Error("SOCKS auth read failed: %v", err)
+		return "", false
+	}
+	password := make([]byte, user[len(user)-1])
+	user = user[:len(user)-1]
+	if _, err := io.ReadFull(client, password); err != nil {
+		logger.Error("SOCKS auth read failed: %v", err)
+		return "", false
+	}
+	agent, ok := authenticateUser(string(user), string(password))
+	if !ok {
+		logger.Error("SOCKS authentication failed for user %q from %v", user, client.RemoteAddr())
+		client.Write([]byte{0x01, 0x01})
+		return "", false
+	}
+	if _, err := client.Write([]byte{0x01, 0x00}); err != nil {
+		return "", false
+	}
+	logger.Debug("SOCKS user %q authenticated from %v", user, client.RemoteAddr())
+	return agent, true
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// balance is how new sessions for a group are spread over its healthy agents:
+// "round-robin", "least-sessions" or "lowest-latency"
+var balance = "round-robin"
+
+// groupNext is the round-robin position of each group; guarded by agentsMu
+var groupNext = make(map[string]int)
+
+// SetBalance sets the strategy that picks an agent of a group for a new session
+func SetBalance(strategy string) error {
+	switch strategy {
+	case "round-robin", "least-sessions", "lowest-latency":
+		balance = strategy
+		return nil
+	}
+	return fmt.Errorf("invalid balance strategy %q: use round-robin, least-sessions or lowest-latency", strategy)
+}
+
+// groupMembers returns the connected agents of group sorted by name; agentsMu
+// must be held
+func groupMembers(group string) []*agentConn {
+	var members []*agentConn
+	for _, a := range agents {
+		if a.group == group {
+			members = append(members, a)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].name < members[j].name })
+	return members
+}
+
+// pickAgent chooses one of the healthy members of group for a new session, or
+// returns nil if none is healthy; agentsMu must be held
+func pickAgent(group string, members []*agentConn) *agentConn {
+	type candidate struct {
+		agent *agentConn
+		rtt   time.Duration
+		load  int
+	}
+	var healthy []candidate
+	for _, a := range members {
+		if ok, rtt, load := a.tunnel.health(); ok {
+			healthy = append(healthy, candidate{a, rtt, load})
+		} else {
+			logger.Debug("Group %q: skipping unhealthy agent %q", group, a.name)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	best := healthy[0]
+	switch balance {
+	case "least-sessions":
+		for _, c := range healthy[1:] {
+			if c.load < best.load {
+				best = c
+			}
+		}
+	case "lowest-latency":
+		// agents without a measured round trip come last
+		for _, c := range healthy[1:] {
+			if c.rtt != 0 && (best.rtt == 0 || c.rtt < best.rtt) {
+				best = c
+			}
+		}
+	default:
+		next := groupNext[group]
+		best = healthy[next%len(healthy)]
+		groupNext[group] = next + 1
+	}
+	logger.Debug("Group %q: %s picked agent %q (rtt %v, %d sessions)", group, balance, best.agent.name, best.rtt, best.load)
+	return best.agent
+}
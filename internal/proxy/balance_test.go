@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pickNames picks n agents of group from members and returns their names
+func pickNames(group string, members []*agentConn, n int) []string {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	var names []string
+	for range n {
+		if a := pickAgent(group, members); a != nil {
+			names = append(names, a.name)
+		}
+	}
+	return names
+}
+
+func TestPickAgentSkipsMissedPong(t *testing.T) {
+	live, _ := tunnelPair(t)
+	// the silent agent's connection swallows everything, as a dropped link would
+	c1, c2 := net.Pipe()
+	silent := newTunnel(c1)
+	go io.Copy(io.Discard, c2)
+	t.Cleanup(func() {
+		silent.close()
+		c2.Close()
+	})
+	members := []*agentConn{
+		{name: "a", group: "g", tunnel: live},
+		{name: "b", group: "g", tunnel: silent},
+	}
+	if got := pickNames("g", members, 2); len(got) != 2 || got[0] == got[1] {
+		t.Fatalf("fresh agents picked %v, want both", got)
+	}
+
+	if err := live.ping(); err != nil {
+		t.Fatal(err)
+	}
+	if err := silent.ping(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		live.mu.Lock()
+		answered := !live.lastPong.Before(live.lastPing)
+		live.mu.Unlock()
+		if answered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("live tunnel did not answer its ping")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := pickNames("g", members, 2); len(got) != 2 || got[0] == got[1] {
+		t.Fatalf("agents within pongTimeout picked %v, want both", got)
+	}
+
+	// the silent agent's ping has now gone unanswered for longer than pongTimeout
+	silent.mu.Lock()
+	silent.lastPing = time.Now().Add(-pongTimeout - time.Second)
+	silent.lastPong = silent.lastPing.Add(-keepaliveInterval)
+	silent.mu.Unlock()
+	for _, name := range pickNames("g", members, 4) {
+		if name != "a" {
+			t.Fatalf("picked agent %q after it missed a pong", name)
+		}
+	}
+
+	live.close()
+	if got := pickNames("g", members, 1); len(got) != 0 {
+		t.Fatalf("picked %v with every tunnel closed or silent", got)
+	}
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// bindTimeout bounds how long the agent waits for the inbound connection of a BIND
+const bindTimeout = 2 * time.Minute
+
+// socksBind asks agent to listen for one inbound connection from target's host and
+// sends the client both BIND replies: the listening address, then the peer
+func socksBind(client net.Conn, agent, target string) {
+	accepted := &pendingConnect{
+		complete: func(t *tunnel, sessID uint32, rep byte, bound []byte) byte {
+			return replyAndStart(t, sessID, client, rep, socksReply(rep, bound))
+		},
+		done: make(chan byte, 1),
+	}
+	t, sessID, rep := openThroughTunnel(agent, openBind, target, func(t *tunnel, sessID uint32, rep byte, bound []byte) byte {
+		if _, err := client.Write(socksReply(rep, bound)); err != nil {
+			logger.Error("Failed to write bind reply for session %08x: %v", sessID, err)
+			if rep == socksRepSucceeded {
+				t.send(frameReset, sessID, nil)
+			}
+			return socksRepGeneralFailure
+		}
+		// wait for the second result, which reports the accepted connection
+		if rep == socksRepSucceeded && !t.addPending(sessID, accepted) {
+			return socksRepGeneralFailure
+		}
+		return rep
+	})
+	if rep != socksRepSucceeded {
+		logger.Error("session %08x bind for %s failed, reply code %#02x", sessID, target, rep)
+		client.Close()
+		return
+	}
+	select {
+	case rep = <-accepted.done:
+	case <-time.After(bindTimeout + connectTimeout):
+		if t.takePending(sessID) == nil {
+			rep = <-accepted.done
+			break
+		}
+		t.send(frameReset, sessID, nil)
+		rep = accepted.complete(t, sessID, socksRepTTLExpired, nil)
+	}
+	if rep != socksRepSucceeded {
+		logger.Error("session %08x bind for %s accepted no connection, reply code %#02x", sessID, target, rep)
+		client.Close()
+		return
+	}
+	logger.Info("session %08x bound for %s via %v", sessID, target, t.conn.RemoteAddr())
+}
+
+// openBindSession listens for one connection from peer's host for the proxy. It
+// reports the listening address, then the accepted peer, as frameOpenResult.
+func openBindSession(t *tunnel, sessID uint32, peer string) {
+	fail := func(rep byte) {
+		t.send(frameOpenResult, sessID, append([]byte{rep}, encodeSOCKSAddr(nil)...))
+	}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		logger.Error("session %08x bind listen failed: %v", sessID, err)
+		fail(socksRepGeneralFailure)
+		return
+	}
+	if !t.addListener(sessID, ln) {
+		ln.Close()
+		return
+	}
+	bound := bindAddr(t, ln, peer)
+	result := append([]byte{socksRepSucceeded}, encodeSOCKSAddr(bound)...)
+	if err := t.send(frameOpenResult, sessID, result); err != nil {
+		if t.removeListener(sessID) != nil {
+			ln.Close()
+		}
+		return
+	}
+	logger.Info("session %08x listening on %v for %s", sessID, bound, peer)
+
+	allowed := bindPeerIPs(peer)
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(bindTimeout))
+	var conn net.Conn
+	for conn == nil {
+		c, err := ln.Accept()
+		if err != nil {
+			if t.removeListener(sessID) == nil {
+				// the proxy cancelled the bind and closed the listener
+				return
+			}
+			ln.Close()
+			logger.Error("session %08x bind accept failed: %v", sessID, err)
+			fail(dialErrorReply(err))
+			return
+		}
+		if !bindPeerAllowed(c.RemoteAddr(), allowed) {
+			logger.Error("session %08x rejecting bind connection from %v", sessID, c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		conn = c
+	}
+	if t.removeListener(sessID) == nil {
+		conn.Close()
+		return
+	}
+	ln.Close()
+	sess := t.addSession(sessID, conn)
+	if sess == nil {
+		conn.Close()
+		return
+	}
+	result = append([]byte{socksRepSucceeded}, encodeSOCKSAddr(conn.RemoteAddr())...)
+	if err := t.send(frameOpenResult, sessID, result); err != nil {
+		logger.Error("session %08x failed to send bind result: %v", sessID, err)
+		sess.abort(false)
+		return
+	}
+	logger.Info("session %08x accepted bind connection from %v", sessID, conn.RemoteAddr())
+	sess.start()
+}
+
+// bindAddr returns the address to report for a bind listener: the local address
+// the agent would use to reach peer, falling back to the tunnel's local address
+func bindAddr(t *tunnel, ln net.Listener, peer string) net.Addr {
+	port := ln.Addr().(*net.TCPAddr).Port
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		// a UDP "connection" picks a route without sending anything
+		if c, err := net.Dial("udp", net.JoinHostPort(host, "9")); err == nil {
+			ip = c.LocalAddr().(*net.UDPAddr).IP
+			c.Close()
+		}
+	}
+	if ip == nil || ip.IsUnspecified() {
+		if a, ok := t.conn.LocalAddr().(*net.TCPAddr); ok {
+			ip = a.IP
+		}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// bindPeerIPs resolves the host a BIND expects its connection from; nil allows any
+// host, as when the client sends 0.0.0.0
+func bindPeerIPs(peer string) []net.IP {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return nil
+		}
+		return []net.IP{ip}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		logger.Debug("Cannot resolve bind peer %s, accepting any host: %v", host, err)
+		return nil
+	}
+	return ips
+}
+
+func bindPeerAllowed(addr net.Addr, allowed []net.IP) bool {
+	if allowed == nil {
+		return true
+	}
+	remote, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ip := range allowed {
+		if ip.Equal(remote.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// connectDirect dials target from the proxy itself, for destinations routed
+// "direct", and pipes client to it. reply is as for connectClient.
+func connectDirect(client net.Conn, target string, reply func(rep byte, bound []byte) []byte) bool {
+	conn, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		logger.Error("Direct connect to %s failed: %v", target, err)
+		if msg := reply(dialErrorReply(err), nil); msg != nil {
+			client.Write(msg)
+		}
+		client.Close()
+		return false
+	}
+	if msg := reply(socksRepSucceeded, encodeSOCKSAddr(conn.LocalAddr())); msg != nil {
+		if _, err := client.Write(msg); err != nil {
+			logger.Error("Failed to write reply for direct connection to %s: %v", target, err)
+			conn.Close()
+			client.Close()
+			return false
+		}
+	}
+	logger.Info("Connected to %s directly", target)
+	go spliceDirect(client, conn, target)
+	return true
+}
+
+// spliceDirect copies both ways between client and conn, passing half-closes on,
+// and closes both once each side is done
+func spliceDirect(client, conn net.Conn, target string) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(conn, client)
+	go copyHalf(client, conn)
+	wg.Wait()
+	client.Close()
+	conn.Close()
+	logger.Info("Direct connection to %s closed", target)
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// dnsTimeout bounds one query from the agent to its DNS server
+const dnsTimeout = 5 * time.Second
+
+// maxDNSMessage is the largest DNS message relayed; the open result needs one byte for REP
+const maxDNSMessage = maxFramePayload - 1
+
+// dnsListenAddr enables the proxy's DNS server when set
+var dnsListenAddr string
+
+// dnsServer is the server the agent forwards queries to; empty means the
+// nameservers in the agent's /etc/resolv.conf
+var dnsServer string
+
+// SetDNSListenAddr serves DNS over UDP and TCP on addr, answering every query
+// through the agent
+func SetDNSListenAddr(addr string) {
+	dnsListenAddr = addr
+}
+
+// SetDNSServer makes the agent send the proxy's DNS queries to server instead of
+// its system nameservers
+func SetDNSServer(server string) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	dnsServer = server
+}
+
+// startDNSListeners serves DNS on dnsListenAddr over UDP and TCP
+func startDNSListeners() {
+	pc, err := net.ListenPacket("udp", dnsListenAddr)
+	if err != nil {
+		logger.Fatalf("DNS listen failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", dnsListenAddr)
+	if err != nil {
+		logger.Fatalf("DNS listen failed: %v", err)
+	}
+	logger.Info("DNS server listening on %s (UDP and TCP)", dnsListenAddr)
+	go serveDNSTCP(ln)
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			logger.Error("DNS read failed: %v", err)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if response := resolveDNS(query, false); response != nil {
+				pc.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+// serveDNSTCP answers length-prefixed DNS queries on TCP connections
+func serveDNSTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Println("Accept error:", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+				query, err := readDNSMessage(conn)
+				if err != nil {
+					return
+				}
+				response := resolveDNS(query, true)
+				if response == nil || writeDNSMessage(conn, response) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// DNS response codes the proxy answers with itself
+const (
+	dnsRcodeServFail = 0x02
+	dnsRcodeRefused  = 0x05
+)
+
+// resolveDNS answers a query as the routing table says for the name it asks
+// about: through the route's agent, from the proxy's own nameservers if the route
+// is direct, or with REFUSED if it rejects the name. A query that cannot be
+// answered gets SERVFAIL. Only queries that came over TCP get a truncated answer
+// replaced by the full one; UDP clients get the truncated answer and retry over
+// TCP themselves, as the answer may not fit their buffer.
+func resolveDNS(query []byte, overTCP bool) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// no port, so only routes without one apply to name lookups
+	name := dnsQuestionName(query)
+	r := routeFor(net.JoinHostPort(name, "0"))
+	switch r.Action {
+	case "reject":
+		logger.Info("Route %q rejects DNS query for %s", r.Match, name)
+		return dnsResponse(query, dnsRcodeRefused)
+	case "direct":
+		response, err := queryNameservers(query, overTCP)
+		if err != nil {
+			logger.Error("Direct DNS query for %s failed: %v", name, err)
+			return dnsResponse(query, dnsRcodeServFail)
+		}
+		return response
+	}
+	cmd := byte(openDNS)
+	if overTCP {
+		cmd = openDNSTCP
+	}
+	var response []byte
+	_, sessID, rep := openThroughTunnel(r.Agent, cmd, string(query), func(_ *tunnel, _ uint32, rep byte, msg []byte) byte {
+		response = msg
+		return rep
+	})
+	if rep != socksRepSucceeded || len(response) < 12 {
+		logger.Error("DNS query %08x failed, reply code %#02x", sessID, rep)
+		return dnsResponse(query, dnsRcodeServFail)
+	}
+	return response
+}
+
+// dnsQuestionName returns the name a query asks about, lower-cased and without
+// the trailing dot, or "" if it has none
+func dnsQuestionName(query []byte) string {
+	if binary.BigEndian.Uint16(query[4:6]) == 0 {
+		return ""
+	}
+	var labels []string
+	for i := 12; i < len(query); {
+		n := int(query[i])
+		if n == 0 {
+			return strings.ToLower(strings.Join(labels, "."))
+		}
+		if n&0xC0 != 0 || i+1+n > len(query) {
+			return ""
+		}
+		labels = append(labels, string(query[i+1:i+1+n]))
+		i += 1 + n
+	}
+	return ""
+}
+
+// dnsResponse turns a query into an empty response with rcode
+func dnsResponse(query []byte, rcode byte) []byte {
+	msg := append([]byte(nil), query...)
+	msg[2] = msg[2]&0x79 | 0x80 // QR, keep opcode and RD
+	msg[3] = rcode
+	return msg
+}
+
+// forwardDNS answers the proxy's DNS query from the configured or system
+// nameservers, retrying truncated answers over TCP if retryTCP is set; the result
+// is REP | DNS response
+func forwardDNS(t *tunnel, sessID uint32, query []byte, retryTCP bool) {
+	response, err := queryNameservers(query, retryTCP)
+	if err != nil {
+		logger.Error("DNS query %08x failed: %v", sessID, err)
+		t.send(frameOpenResult, sessID, []byte{dialErrorReply(err)})
+		return
+	}
+	t.send(frameOpenResult, sessID, append([]byte{socksRepSucceeded}, response...))
+}
+
+// queryNameservers sends query to the configured or system nameservers in turn
+// until one answers, retrying truncated answers over TCP if retryTCP is set
+func queryNameservers(query []byte, retryTCP bool) ([]byte, error) {
+	servers := []string{dnsServer}
+	if dnsServer == "" {
+		servers = systemNameservers()
+	}
+	err := errors.New("no DNS server configured")
+	for _, server := range servers {
+		var response []byte
+		if response, err = exchangeDNS(server, query, retryTCP); err == nil {
+			return response, nil
+		}
+		logger.Debug("DNS query to %s failed: %v", server, err)
+	}
+	return nil, err
+}
+
+// exchangeDNS sends query to server over UDP, retrying over TCP if the answer
+// was truncated and retryTCP is set
+func exchangeDNS(server string, query []byte, retryTCP bool) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams that do not answer our query ID
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 || !retryTCP {
+			return buf[:n], nil
+		}
+		break
+	}
+	tcpConn, err := net.DialTimeout("tcp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := writeDNSMessage(tcpConn, query); err != nil {
+		return nil, err
+	}
+	return readDNSMessage(tcpConn)
+}
+
+// readDNSMessage reads one DNS message with its 2-byte TCP length prefix
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	if len(msg) > maxDNSMessage {
+		return nil, errors.New("DNS message too large")
+	}
+	return msg, nil
+}
+
+// writeDNSMessage writes msg with its 2-byte TCP length prefix
+func writeDNSMessage(conn net.Conn, msg []byte) error {
+	return writeFull(conn, append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+}
+
+// systemNameservers returns the nameservers listed in /etc/resolv.conf
+func systemNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
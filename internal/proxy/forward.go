@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// Forward is a static port forward: connections accepted on Local are tunnelled to
+// Remote, which the agent dials. Agent names the agent to use; empty means the
+// default agent.
+type Forward struct {
+	Local  string `yaml:"local"`
+	Remote string `yaml:"remote"`
+	Agent  string `yaml:"agent"`
+}
+
+// forwards are the static forwards the proxy listens for
+var forwards []Forward
+
+// SetForwards makes the proxy listen for each forward alongside the SOCKS5 listener
+func SetForwards(fwds []Forward) {
+	forwards = fwds
+}
+
+// ParseForward parses "local=remote[@agent]", where local is an address or a bare
+// port on 127.0.0.1 and remote is a "host:port" in the agent's network
+func ParseForward(s string) (Forward, error) {
+	spec, agent := cutAgent(s)
+	local, remote, ok := strings.Cut(spec, "=")
+	if !ok {
+		return Forward{}, fmt.Errorf("invalid forward %q: want local=remote", s)
+	}
+	f := Forward{Local: local, Remote: remote, Agent: agent}
+	return f, f.validate()
+}
+
+// cutAgent splits an optional "@agent" suffix off a forward spec
+func cutAgent(s string) (string, string) {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// validate checks the addresses, defaulting a bare local port to 127.0.0.1
+func (f *Forward) validate() error {
+	if !strings.Contains(f.Local, ":") {
+		f.Local = net.JoinHostPort("127.0.0.1", f.Local)
+	}
+	if _, _, err := net.SplitHostPort(f.Local); err != nil {
+		return fmt.Errorf("invalid forward local address %q: %v", f.Local, err)
+	}
+	if _, _, err := net.SplitHostPort(f.Remote); err != nil {
+		return fmt.Errorf("invalid forward remote address %q: %v", f.Remote, err)
+	}
+	return nil
+}
+
+// startForwardListeners listens for every configured forward
+func startForwardListeners() {
+	for _, f := range forwards {
+		if err := f.validate(); err != nil {
+			logger.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", f.Local)
+		if err != nil {
+			logger.Fatalf("Forward listen on %s failed: %v", f.Local, err)
+		}
+		if f.Agent != "" {
+			logger.Info("Forwarding %s to %s via agent %q", f.Local, f.Remote, f.Agent)
+		} else {
+			logger.Info("Forwarding %s to %s via the agent", f.Local, f.Remote)
+		}
+		go serveForward(ln, f)
+	}
+}
+
+// serveForward connects every connection accepted on ln to f.Remote as the
+// routing table says, unless the forward names its agent
+func serveForward(ln net.Listener, f Forward) {
+	r := agentRoute(f.Agent)
+	if f.Agent == "" {
+		r = routeFor(f.Remote)
+	}
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			logger.Println("Accept error:", err)
+			continue
+		}
+		logger.Info("Forward request from %v to %s", client.RemoteAddr(), f.Remote)
+		go connectRoute(client, r, f.Remote, noReply)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Every message on a tunnel is a frame:
+//
+//	VER (1) | TYPE (1) | SESSION ID (4) | LENGTH (2) | PAYLOAD (LENGTH)
+//
+// A session starts with frameOpen from the proxy and is answered by frameOpenResult
+// from the agent. Data then flows in frameData frames until both sides have sent
+// frameHalfClose, or either side aborts the session with frameReset. A BIND session
+// gets two results: the agent's listening address, then the accepted peer. Reverse
+// forwards are the one case where the agent opens sessions toward the proxy.
+//
+// Each direction of a session is flow controlled: a sender may have at most
+// initialWindow bytes of unacknowledged data in flight, and the receiver returns
+// credit with frameWindow as it writes data out.
+const frameVersion = 0x01
+
+const frameHeaderLen = 8
+
+// maxFramePayload is the largest payload a single frame can carry
+const maxFramePayload = 0xffff
+
+// Frame types
+const (
+	frameOpen       = 0x01 // open a session; payload is an open command byte and the target "host:port"
+	frameOpenResult = 0x02 // connect result; payload is REP | ATYP | BND.ADDR | BND.PORT
+	frameData       = 0x03 // session payload
+	frameHalfClose  = 0x04 // sender will send no more data for the session
+	frameReset      = 0x05 // session aborted; the receiver drops it without replying
+	framePing       = 0x06 // keepalive; echoed back as framePong
+	framePong       = 0x07 // reply to framePing
+	frameWindow     = 0x08 // flow control credit; payload is a 4-byte byte count
+	frameDatagram   = 0x09 // UDP datagram; payload is ATYP | ADDR | PORT | DATA
+	frameHello      = 0x0A // agent introduction, sent first; payload is "key=value" lines
+)
+
+// Open commands, the first byte of a frameOpen payload. SOCKS commands keep their
+// CMD values. All are sent by the proxy except openForwarded, which the agent sends
+// with agentSessionBit set in the session ID.
+const (
+	openConnect      = 0x01 // dial a TCP target and stream it
+	openBind         = 0x02 // accept one inbound TCP connection from the target host and stream it
+	openUDPAssociate = 0x03 // open a UDP socket carrying frameDatagram traffic
+	openListen       = 0x10 // listen on the target address for a reverse forward
+	openForwarded    = 0x11 // a reverse forward accepted a connection; the rest is the 4-byte forward ID
+	openDNS          = 0x12 // answer the DNS query that follows; the result is REP | DNS response
+	openDNSTCP       = 0x13 // as openDNS for a query that came over TCP; truncated answers are retried over TCP
+	openResolve      = 0xF0 // resolve the target host to an address (Tor RESOLVE)
+	openResolvePTR   = 0xF1 // resolve the target address to a name (Tor RESOLVE_PTR)
+)
+
+var errFrameVersion = errors.New("unsupported tunnel frame version")
+
+type frame struct {
+	typ     byte
+	sessID  uint32
+	payload []byte
+}
+
+// readFrame reads one complete frame from r
+func readFrame(r io.Reader) (frame, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	if hdr[0] != frameVersion {
+		return frame{}, fmt.Errorf("%w: %d", errFrameVersion, hdr[0])
+	}
+	f := frame{
+		typ:     hdr[1],
+		sessID:  binary.BigEndian.Uint32(hdr[2:6]),
+		payload: make([]byte, binary.BigEndian.Uint16(hdr[6:8])),
+	}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
+
+// writeFrame writes header and payload in a single write; callers serialize writes
+func writeFrame(conn net.Conn, typ byte, sessID uint32, payload []byte) error {
+	if len(payload) > maxFramePayload {
+		return fmt.Errorf("frame payload too large: %d bytes", len(payload))
+	}
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(payload))
+	buf[0] = frameVersion
+	buf[1] = typ
+	binary.BigEndian.PutUint32(buf[2:6], sessID)
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(payload)))
+	return writeFull(conn, append(buf, payload...))
+}
+
+func writeFull(conn net.Conn, data []byte) error {
+	total := 0
+	for total < len(data) {
+		n, err := conn.Write(data[total:])
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	return nil
+}
+
+// frameTypeName returns a readable name for debug logging
+func frameTypeName(typ byte) string {
+	switch typ {
+	case frameOpen:
+		return "OPEN"
+	case frameOpenResult:
+		return "OPEN_RESULT"
+	case frameData:
+		return "DATA"
+	case frameHalfClose:
+		return "HALF_CLOSE"
+	case frameReset:
+		return "RESET"
+	case framePing:
+		return "PING"
+	case framePong:
+		return "PONG"
+	case frameWindow:
+		return "WINDOW"
+	case frameDatagram:
+		return "DATAGRAM"
+	case frameHello:
+		return "HELLO"
+	default:
+		return fmt.Sprintf("UNKNOWN(%#02x)", typ)
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []frame{
+		{typ: frameOpen, sessID: 0x01020304, payload: append([]byte{openConnect}, "example.com:443"...)},
+		{typ: frameHalfClose, sessID: agentSessionBit | 7, payload: []byte{}},
+		{typ: frameData, sessID: 42, payload: bytes.Repeat([]byte{0xAB}, maxFramePayload)},
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	errc := make(chan error, 1)
+	go func() {
+		for _, f := range frames {
+			if err := writeFrame(c1, f.typ, f.sessID, f.payload); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i, want := range frames {
+		got, err := readFrame(c2)
+		if err != nil {
+			t.Fatalf("frame %d: readFrame: %v", i, err)
+		}
+		if got.typ != want.typ || got.sessID != want.sessID || !bytes.Equal(got.payload, want.payload) {
+			t.Fatalf("frame %d: got type %#02x session %08x (%d bytes), want type %#02x session %08x (%d bytes)",
+				i, got.typ, got.sessID, len(got.payload), want.typ, want.sessID, len(want.payload))
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+}
+
+func TestReadFrameBadVersion(t *testing.T) {
+	hdr := []byte{frameVersion + 1, frameData, 0, 0, 0, 1, 0, 0}
+	if _, err := readFrame(bytes.NewReader(hdr)); !errors.Is(err, errFrameVersion) {
+		t.Fatalf("readFrame with version %d: got %v, want errFrameVersion", hdr[0], err)
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := writeFrame(c1, frameData, 1, make([]byte, maxFramePayload+1)); err == nil {
+		t.Fatal("writeFrame accepted a payload over maxFramePayload")
+	}
+	// nothing may have been written for the oversized frame
+	c2.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := c2.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("oversized frame wrote %d bytes", n)
+	}
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// httpListenAddr enables the HTTP proxy front-end when set
+var httpListenAddr string
+
+// SetHTTPListenAddr serves HTTP CONNECT and forward-proxy requests on addr
+// alongside the SOCKS5 listener
+func SetHTTPListenAddr(addr string) {
+	httpListenAddr = addr
+}
+
+// hopHeaders are connection-specific headers a proxy must not forward (RFC 9110, section 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// startHTTPListener accepts HTTP proxy clients on httpListenAddr
+func startHTTPListener() {
+	ln, err := net.Listen("tcp", httpListenAddr)
+	if err != nil {
+		logger.Fatalf("HTTP proxy listen failed: %v", err)
+	}
+	logger.Info("HTTP proxy listening on %s", httpListenAddr)
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			logger.Println("Accept error:", err)
+			continue
+		}
+		go handleHTTP(client)
+	}
+}
+
+// handleHTTP serves one HTTP proxy request: CONNECT tunnels the connection to the
+// target, an absolute-URI request is forwarded to its origin server. Either way the
+// connection becomes a tunnel session. A forwarded request is the only one on its
+// connection: the origin is asked to close after responding, the client is told
+// its connection closes with the response, and anything it sends after the request
+// is not relayed, so each request is routed on a connection of its own.
+func handleHTTP(client net.Conn) {
+	br := bufio.NewReader(client)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		logger.Error("HTTP proxy request read failed: %v", err)
+		client.Close()
+		return
+	}
+	// as with SOCKS, the username may pick the agent
+	user, password, hasAuth := proxyBasicAuth(req)
+	agent, ok := "", socksCredentials == nil
+	if hasAuth {
+		agent, ok = authenticateUser(user, password)
+	}
+	if !ok {
+		logger.Error("HTTP proxy authentication failed for user %q from %v", user, client.RemoteAddr())
+		client.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: Basic realm=\"reverse-soxy\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		client.Close()
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		target := req.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			httpError(client, http.StatusBadRequest)
+			return
+		}
+		logger.Info("HTTP CONNECT to %s", target)
+		connectRoute(&bufferedConn{Conn: client, r: br}, routeForUser(target, agent), target, httpConnectReply)
+		return
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		logger.Error("HTTP proxy request for %q is not an absolute http URI", req.RequestURI)
+		httpError(client, http.StatusBadRequest)
+		return
+	}
+	target := req.URL.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(strings.Trim(target, "[]"), "80")
+	}
+	logger.Info("HTTP %s %s", req.Method, req.URL)
+	// the rewritten head goes first, then the body as the client sends it
+	head := forwardHead(req)
+	conn := &forwardConn{bufferedConn: bufferedConn{Conn: client, r: io.MultiReader(bytes.NewReader(head), forwardBody(req))}}
+	connectRoute(conn, routeForUser(target, agent), target, httpForwardReply)
+}
+
+// forwardHead rewrites an absolute-URI proxy request into an origin-form request
+// head, dropping hop-by-hop headers
+func forwardHead(req *http.Request) []byte {
+	for _, name := range req.Header.Values("Connection") {
+		for _, h := range strings.Split(name, ",") {
+			req.Header.Del(strings.TrimSpace(h))
+		}
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	req.Header.Write(&buf)
+	if len(req.TransferEncoding) > 0 {
+		// the body is relayed as received, so keep its framing
+		fmt.Fprintf(&buf, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", "))
+	}
+	buf.WriteString("Connection: close\r\n\r\n")
+	return buf.Bytes()
+}
+
+// forwardBody returns the body of req as it goes to the origin, framed as the client
+// sent it, ending where the request ends
+func forwardBody(req *http.Request) io.Reader {
+	if len(req.TransferEncoding) > 0 {
+		return &chunkedBody{body: req.Body}
+	}
+	return req.Body
+}
+
+// chunkedBody re-frames a chunked request body, which net/http decodes, as it is read
+type chunkedBody struct {
+	body io.Reader
+	buf  []byte
+	done bool
+}
+
+func (c *chunkedBody) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, 32*1024)
+		n, err := c.body.Read(chunk)
+		if n > 0 {
+			c.buf = fmt.Appendf(nil, "%x\r\n%s\r\n", n, chunk[:n])
+		}
+		if err == io.EOF {
+			c.buf = append(c.buf, "0\r\n\r\n"...)
+			c.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// maxResponseHead bounds how much of a response head forwardConn buffers to rewrite
+const maxResponseHead = 64 * 1024
+
+// forwardConn is the client connection of a forwarded request. It rewrites the
+// origin's final response head to say "Connection: close", since the connection
+// ends with the response.
+type forwardConn struct {
+	bufferedConn
+	head     []byte // response head received so far
+	headDone bool
+}
+
+func (c *forwardConn) Write(p []byte) (int, error) {
+	if c.headDone {
+		return c.Conn.Write(p)
+	}
+	c.head = append(c.head, p...)
+	var out []byte
+	for !c.headDone {
+		end := bytes.Index(c.head, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(c.head) > maxResponseHead {
+				c.headDone = true
+				out, c.head = append(out, c.head...), nil
+			}
+			break
+		}
+		head, rest := c.head[:end+2], c.head[end+2:]
+		if bytes.HasPrefix(head, []byte("HTTP/1.1 1")) || bytes.HasPrefix(head, []byte("HTTP/1.0 1")) {
+			// interim responses such as 100 Continue pass through; the final one follows
+			out = append(out, c.head[:end+4]...)
+			c.head = c.head[end+4:]
+			continue
+		}
+		c.headDone = true
+		out = append(append(out, closeResponseHead(head)...), rest...)
+		c.head = nil
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// closeResponseHead replaces the connection headers of a response head, status line
+// and header lines each ending in CRLF, with "Connection: close"
+func closeResponseHead(head []byte) []byte {
+	var out []byte
+	for i, line := range bytes.SplitAfter(head, []byte("\r\n")) {
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		if i > 0 && (bytes.EqualFold(bytes.TrimSpace(name), []byte("Connection")) || bytes.EqualFold(bytes.TrimSpace(name), []byte("Keep-Alive"))) {
+			continue
+		}
+		out = append(out, line...)
+	}
+	return append(out, "Connection: close\r\n"...)
+}
+
+// proxyBasicAuth returns the credentials of a Proxy-Authorization Basic header
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	// reuse net/http's Basic parsing, which only looks at Authorization
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
+
+// httpConnectReply answers a CONNECT with 200 or the status matching the agent's result
+func httpConnectReply(rep byte, _ []byte) []byte {
+	if rep == socksRepSucceeded {
+		return []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	return httpErrorResponse(httpStatus(rep))
+}
+
+// httpForwardReply sends nothing on success, since the origin's response follows
+func httpForwardReply(rep byte, _ []byte) []byte {
+	if rep == socksRepSucceeded {
+		return nil
+	}
+	return httpErrorResponse(httpStatus(rep))
+}
+
+// httpStatus maps a SOCKS5 reply code to the closest HTTP status
+func httpStatus(rep byte) int {
+	switch rep {
+	case socksRepNotAllowed:
+		return http.StatusForbidden
+	case socksRepTTLExpired:
+		return http.StatusGatewayTimeout
+	case socksRepNetUnreachable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func httpErrorResponse(status int) []byte {
+	text := http.StatusText(status)
+	return fmt.Appendf(nil, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+		status, text, len(text)+1, text)
+}
+
+// httpError replies with status and closes the client
+func httpError(client net.Conn, status int) {
+	client.Write(httpErrorResponse(status))
+	client.Close()
+}
+
+// bufferedConn reads from r instead of the connection, so bytes the client sent
+// ahead of the proxy's reply are not lost
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite forwards half-closes to the underlying connection
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// readHTTPRequest parses one request from r, as handleHTTP does
+func readHTTPRequest(r io.Reader) (*http.Request, error) {
+	return http.ReadRequest(bufio.NewReader(r))
+}
+
+func TestForwardConnClosesResponse(t *testing.T) {
+	response := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nKeep-Alive: timeout=5\r\nContent-Length: 2\r\n\r\nok"
+	want := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+	client, far := net.Pipe()
+	defer far.Close()
+	c := &forwardConn{bufferedConn: bufferedConn{Conn: client}}
+	go func() {
+		// the origin's bytes arrive in arbitrary pieces
+		for i := 0; i < len(response); i += 7 {
+			if _, err := c.Write([]byte(response[i:min(i+7, len(response))])); err != nil {
+				return
+			}
+		}
+		client.Close()
+	}()
+	got, err := io.ReadAll(far)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("client got\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestForwardBodyChunked(t *testing.T) {
+	body := strings.Repeat("x", 40*1024)
+	raw := "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"a000\r\n" + body + "\r\n0\r\n\r\n" +
+		"GET http://other.example/ HTTP/1.1\r\nHost: other.example\r\n\r\n"
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c2.Write([]byte(raw))
+	req, err := readHTTPRequest(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed, err := io.ReadAll(forwardBody(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(framed), "0\r\n\r\n") || strings.Contains(string(framed), "other.example") {
+		t.Fatalf("forwarded body is not exactly the chunked request body: %q...", framed[max(0, len(framed)-40):])
+	}
+	decoded, err := readHTTPRequest(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" + string(framed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(decoded.Body); string(got) != body {
+		t.Fatalf("re-framed body decodes to %d bytes, want %d", len(got), len(body))
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// identityKey signs our side of the handshake when set
+var identityKey ed25519.PrivateKey
+
+// authorizedAgentsPath lists the agent keys the proxy accepts; when set, agents must
+// authenticate with a listed key instead of the shared secret
+var authorizedAgentsPath string
+
+// proxyPublicKey pins the key the agent expects the proxy to authenticate with
+var proxyPublicKey ed25519.PublicKey
+
+// SetIdentity sets the Ed25519 key used to authenticate this side of the tunnel
+func SetIdentity(key ed25519.PrivateKey) {
+	identityKey = key
+}
+
+// SetAuthorizedAgents sets the authorized-agents file checked on every agent handshake
+func SetAuthorizedAgents(path string) {
+	authorizedAgentsPath = path
+}
+
+// SetProxyPublicKey pins the public key the agent requires the proxy to prove
+func SetProxyPublicKey(pub ed25519.PublicKey) {
+	proxyPublicKey = pub
+}
+
+// GenerateIdentity creates a new Ed25519 identity, writes the private key to path
+// and returns the encoded public key
+func GenerateIdentity(path string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return EncodePublicKey(pub), nil
+}
+
+// LoadIdentity reads an Ed25519 private key written by GenerateIdentity
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// EncodePublicKey formats a public key as "ed25519:<base64>"
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return "ed25519:" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// ParsePublicKey parses a public key written by EncodePublicKey; the "ed25519:"
+// prefix is optional
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(s), "ed25519:"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key: wrong length")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// lookupAuthorizedAgent returns the name listed for pub in the authorized-agents
+// file. The file is read on every call so that removing a line revokes the agent
+// without a restart; see watchAuthorizedAgents. Each non-comment line is:
+//
+//	<name> <public key>
+func lookupAuthorizedAgent(pub ed25519.PublicKey) (string, error) {
+	f, err := os.Open(authorizedAgentsPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("%s:%d: expected \"<name> <public key>\"", authorizedAgentsPath, lineNo)
+		}
+		key, err := ParsePublicKey(fields[1])
+		if err != nil {
+			return "", fmt.Errorf("%s:%d: %w", authorizedAgentsPath, lineNo, err)
+		}
+		if key.Equal(pub) {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%w: agent key %s is not authorized", errAuthFailed, EncodePublicKey(pub))
+}
+
+// authorizedAgentsPoll is how often the proxy checks the authorized-agents file
+// for changes
+const authorizedAgentsPoll = 5 * time.Second
+
+// watchAuthorizedAgents re-checks connected agents whenever the authorized-agents
+// file changes and closes the tunnels of agents whose key is no longer listed, or
+// is now listed under another name
+func watchAuthorizedAgents() {
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(authorizedAgentsPath); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+	for range time.Tick(authorizedAgentsPoll) {
+		fi, err := os.Stat(authorizedAgentsPath)
+		if err != nil {
+			logger.Error("Checking authorized agents: %v", err)
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+		logger.Info("Authorized agents file %s changed, re-checking connected agents", authorizedAgentsPath)
+		revokeAgents()
+	}
+}
+
+// revokeAgents closes the tunnels of connected agents the authorized-agents file no
+// longer lets in. A file that cannot be read or parsed revokes no one, so a
+// half-written edit does not drop every agent.
+func revokeAgents() {
+	agentsMu.Lock()
+	connected := make([]*agentConn, 0, len(agents))
+	for _, a := range agents {
+		if peerKey(a.tunnel.conn) != nil {
+			connected = append(connected, a)
+		}
+	}
+	agentsMu.Unlock()
+	for _, a := range connected {
+		name, err := lookupAuthorizedAgent(peerKey(a.tunnel.conn))
+		switch {
+		case errors.Is(err, errAuthFailed):
+			logger.Info("Agent %q is no longer authorized, closing its tunnel", a.name)
+		case err != nil:
+			logger.Error("Checking authorized agents: %v", err)
+			return
+		case name != a.name:
+			logger.Info("Agent %q is now authorized as %q, closing its tunnel", a.name, name)
+		default:
+			continue
+		}
+		a.tunnel.close()
+	}
+}
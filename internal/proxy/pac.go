@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// PACRule sends hosts matching Match to the proxy or direct. Match is a domain
+// ("corp.example" also covers its subdomains), a shell glob ("*.corp.*", "*") or
+// an IP network in CIDR notation.
+type PACRule struct {
+	Match  string `yaml:"match"`
+	Action string `yaml:"action"` // "proxy" or "direct"
+}
+
+// pacConfig is the PAC file server configuration
+var pacConfig struct {
+	listenAddr string
+	proxyAddr  string
+	rules      []PACRule
+}
+
+// SetPAC serves a proxy auto-config file on listenAddr built from rules, checked
+// in order; hosts matching no rule go direct. Without rules the file follows the
+// routing table instead (see pacScript). proxyAddr is the SOCKS address the
+// browser should use; when empty or unspecified, the host the PAC file was
+// requested from is used with the SOCKS listener's port.
+func SetPAC(listenAddr, proxyAddr string, rules []PACRule) error {
+	for _, r := range rules {
+		if r.Action != "proxy" && r.Action != "direct" {
+			return fmt.Errorf("PAC rule %q: action must be proxy or direct, not %q", r.Match, r.Action)
+		}
+		if r.Match == "" {
+			return fmt.Errorf("PAC rule with action %q has no match", r.Action)
+		}
+		if strings.Contains(r.Match, "/") {
+			if _, _, err := net.ParseCIDR(r.Match); err != nil {
+				return fmt.Errorf("PAC rule %q: %v", r.Match, err)
+			}
+		}
+	}
+	pacConfig.listenAddr = listenAddr
+	pacConfig.proxyAddr = proxyAddr
+	pacConfig.rules = rules
+	return nil
+}
+
+// startPACServer serves the PAC file as /proxy.pac and /wpad.dat
+func startPACServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", servePAC)
+	mux.HandleFunc("/wpad.dat", servePAC)
+	logger.Info("PAC file served on http://%s/proxy.pac", pacConfig.listenAddr)
+	if err := http.ListenAndServe(pacConfig.listenAddr, mux); err != nil {
+		logger.Fatalf("PAC server failed: %v", err)
+	}
+}
+
+func servePAC(w http.ResponseWriter, r *http.Request) {
+	logger.Debug("PAC file requested by %s", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Write([]byte(pacScript(pacProxyAddr(r.Host))))
+}
+
+// pacProxyAddr returns the SOCKS address to put in the PAC file for a request
+// made to requestHost
+func pacProxyAddr(requestHost string) string {
+	addr := pacConfig.proxyAddr
+	if addr == "" {
+		addr = socksListenAddr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if h, _, err := net.SplitHostPort(requestHost); err == nil {
+			requestHost = h
+		}
+		return net.JoinHostPort(strings.Trim(requestHost, "[]"), port)
+	}
+	return addr
+}
+
+// pacScript generates FindProxyForURL from the configured rules. Without rules it
+// mirrors the routing table, so browsers only bypass the proxy for what the proxy
+// would connect to directly anyway: direct routes go DIRECT, while agent and reject
+// routes, routes limited to a port, and destinations matching no route go to the
+// proxy, which connects or refuses them itself.
+func pacScript(proxyAddr string) string {
+	var b strings.Builder
+	proxy := strconv.Quote("SOCKS5 " + proxyAddr + "; SOCKS " + proxyAddr)
+	direct := strconv.Quote("DIRECT")
+	b.WriteString("// generated by reverse-soxy\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fallback := direct
+	if len(pacConfig.rules) > 0 {
+		for _, r := range pacConfig.rules {
+			result := direct
+			if r.Action == "proxy" {
+				result = proxy
+			}
+			fmt.Fprintf(&b, "  if (%s) return %s;\n", pacCondition(r.Match), result)
+		}
+	} else {
+		for i := range routes {
+			result := proxy
+			if routes[i].Action == "direct" && routes[i].port == 0 {
+				result = direct
+			}
+			fmt.Fprintf(&b, "  if (%s) return %s;\n", routeCondition(&routes[i]), result)
+		}
+		fallback = proxy
+	}
+	fmt.Fprintf(&b, "  return %s;\n}\n", fallback)
+	return b.String()
+}
+
+// routeCondition returns the JavaScript test for a route's match. Like the proxy,
+// it only matches networks against hosts given as addresses.
+func routeCondition(r *route) string {
+	switch {
+	case r.network == nil:
+		if r.glob != "" {
+			return pacCondition(r.glob)
+		}
+		return pacCondition(r.domain)
+	case r.network.IP.To4() != nil:
+		return fmt.Sprintf("/^[0-9.]+$/.test(host) && %s", pacCondition(r.network.String()))
+	default:
+		return fmt.Sprintf("host.indexOf(\":\") >= 0 && %s", pacCondition(r.network.String()))
+	}
+}
+
+// pacCondition returns the JavaScript test for a rule's match
+func pacCondition(match string) string {
+	if _, ipnet, err := net.ParseCIDR(match); err == nil {
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			return fmt.Sprintf("isInNet(host, %q, %q)", ip4.String(), net.IP(ipnet.Mask).String())
+		}
+		// isInNetEx is the IPv6-capable extension supported by Chromium and Windows
+		return fmt.Sprintf("typeof isInNetEx == \"function\" && isInNetEx(host, %q)", ipnet.String())
+	}
+	if strings.ContainsAny(match, "*?") {
+		return fmt.Sprintf("shExpMatch(host, %q)", match)
+	}
+	domain := strings.TrimPrefix(match, ".")
+	return fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", domain, "."+domain)
+}
@@ -1,13 +1,14 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/lonepie/reverse-soxy/internal/logger"
 )
@@ -21,13 +22,8 @@ var tunnelListenPort int
 // tunnelSecret is used to authenticate and encrypt tunnel connections
 var tunnelSecret string
 
-var (
-	tunnelConn    net.Conn
-	tunnelWriteMu sync.Mutex
-	tunnelMu      sync.Mutex
-	clientSess    = make(map[uint32]net.Conn)
-	clientMu      sync.Mutex
-)
+// connectTimeout bounds how long a client waits for the agent's connect result
+const connectTimeout = 30 * time.Second
 
 // RunProxy starts the SOCKS5 proxy frontend and tunnel listener.
 func RunProxy(proxyAddr string, port int, secret string) {
@@ -37,24 +33,46 @@ func RunProxy(proxyAddr string, port int, secret string) {
 	tunnelSecret = secret
 	logger.Info("Listening for tunnel on port %d", tunnelListenPort)
 	go startTunnelListener()
+	if authorizedAgentsPath != "" {
+		go watchAuthorizedAgents()
+	}
+	startFrontends()
 
 	ln, err := net.Listen("tcp", socksListenAddr)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	logger.Info("SOCKS5 proxy listening on %s", socksListenAddr)
+	logger.Info("Proxy listening on %s (SOCKS5, SOCKS4, HTTP)", socksListenAddr)
 	for {
 		client, err := ln.Accept()
 		if err != nil {
 			logger.Println("Accept error:", err)
 			continue
 		}
-		go handleSOCKS(client)
+		go handleClient(client)
 	}
 }
 
+// startFrontends starts the optional listeners that share the tunnel with the
+// SOCKS5 listener
+func startFrontends() {
+	if httpListenAddr != "" {
+		go startHTTPListener()
+	}
+	if transparentListenAddr != "" {
+		go startTransparentListener()
+	}
+	if dnsListenAddr != "" {
+		go startDNSListeners()
+	}
+	if pacConfig.listenAddr != "" {
+		go startPACServer()
+	}
+	startForwardListeners()
+}
+
 func startTunnelListener() {
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(tunnelListenPort))
+	ln, err := listenTunnel(":" + strconv.Itoa(tunnelListenPort))
 	if err != nil {
 		logger.Fatalf("Tunnel listener failed: %v", err)
 	}
@@ -63,25 +81,26 @@ func startTunnelListener() {
 		if err != nil {
 			logger.Fatal("Tunnel accept failed:", err)
 		}
-		// secure the tunnel connection
-		secureConn, err := NewSecureServerConn(rawConn, tunnelSecret)
-		if err != nil {
-			logger.Error("Secure handshake failed: %v", err)
-			rawConn.Close()
-			continue
-		}
-		tunnelMu.Lock()
-		if tunnelConn != nil {
-			logger.Info("Closing previous tunnel connection")
-			tunnelConn.Close() // This will cause the old goroutine to exit
-		}
-		tunnelConn = secureConn
-		if tcpConn, ok := secureConn.(*net.TCPConn); ok {
-			tcpConn.SetNoDelay(true)
-		}
-		tunnelMu.Unlock()
-		logger.Info("Tunnel connected from %v", secureConn.RemoteAddr())
-		go handleTunnelReadsClient(secureConn)
+		go acceptAgent(rawConn)
+	}
+}
+
+// handleClient detects the client's protocol from its first byte: SOCKS5 and SOCKS4
+// start with their version number, anything else is treated as an HTTP request
+func handleClient(client net.Conn) {
+	br := bufio.NewReader(client)
+	first, err := br.Peek(1)
+	if err != nil {
+		logger.Debug("Client %v closed before sending a request: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+	conn := &bufferedConn{Conn: client, r: br}
+	switch first[0] {
+	case 0x05, 0x04:
+		handleSOCKS(conn)
+	default:
+		handleHTTP(conn)
 	}
 }
 
@@ -94,6 +113,10 @@ func handleSOCKS(client net.Conn) {
 		client.Close()
 		return
 	}
+	if buf[0] == 0x04 {
+		handleSOCKS4(client, buf[:n])
+		return
+	}
 	if buf[0] != 0x05 {
 		logger.Error("Unsupported SOCKS version: %v", buf[0])
 		client.Close()
@@ -108,26 +131,46 @@ func handleSOCKS(client net.Conn) {
 			return
 		}
 	}
-	// Step 2: Server selects 'no auth'
-	_, err = client.Write([]byte{0x05, 0x00})
+	// Step 2: Server selects username/password when credentials are configured or
+	// the client offers it, since the username can pick the agent; otherwise 'no auth'
+	method := byte(0x00)
+	if socksCredentials != nil || bytes.IndexByte(buf[2:2+methods], 0x02) >= 0 {
+		method = 0x02
+	}
+	if !bytes.Contains(buf[2:2+methods], []byte{method}) {
+		logger.Error("SOCKS client %v offered no acceptable auth method", client.RemoteAddr())
+		client.Write([]byte{0x05, 0xFF})
+		client.Close()
+		return
+	}
+	_, err = client.Write([]byte{0x05, method})
 	if err != nil {
 		logger.Error("Failed to write SOCKS5 method selection: %v", err)
 		client.Close()
 		return
 	}
+	var userAgent string
+	if method == 0x02 {
+		var ok bool
+		if userAgent, ok = socksUserPassAuth(client); !ok {
+			client.Close()
+			return
+		}
+	}
 
-	// Step 3: Client connect request
+	// Step 3: Client request
 	n, err = io.ReadAtLeast(client, buf, 5)
 	if err != nil {
-		logger.Error("SOCKS connect request failed: %v", err)
+		logger.Error("SOCKS request failed: %v", err)
 		client.Close()
 		return
 	}
-	if buf[0] != 0x05 || buf[1] != 0x01 {
-		logger.Error("Only SOCKS5 CONNECT supported")
+	if buf[0] != 0x05 {
+		logger.Error("Unsupported SOCKS version in request: %v", buf[0])
 		client.Close()
 		return
 	}
+	cmd := buf[1]
 	addrType := buf[3]
 	var target string
 	addrLen := 0
@@ -140,6 +183,7 @@ func handleSOCKS(client net.Conn) {
 		addrLen = 16
 	default:
 		logger.Error("Unsupported address type: %v", addrType)
+		client.Write(socksReply(socksRepAddrNotSupported, nil))
 		client.Close()
 		return
 	}
@@ -148,7 +192,7 @@ func handleSOCKS(client net.Conn) {
 	if n < reqLen {
 		_, err = io.ReadFull(client, buf[n:reqLen])
 		if err != nil {
-			logger.Error("SOCKS connect request addr/port read failed: %v", err)
+			logger.Error("SOCKS request addr/port read failed: %v", err)
 			client.Close()
 			return
 		}
@@ -169,165 +213,170 @@ func handleSOCKS(client net.Conn) {
 		port := binary.BigEndian.Uint16(buf[20:22])
 		target = fmt.Sprintf("[%s]:%d", ip.String(), port)
 	}
-	logger.Info("Request to %s", target)
 
-	// Step 4: Send connect reply (success)
-	reply := make([]byte, 10)
-	reply[0] = 0x05 // version
-	reply[1] = 0x00 // success
-	reply[2] = 0x00 // reserved
-	reply[3] = 0x01 // IPv4
-	copy(reply[4:], net.ParseIP("127.0.0.1").To4())
-	binary.BigEndian.PutUint16(reply[8:], 1080) // bound port
-	_, err = client.Write(reply)
-	if err != nil {
-		logger.Error("Failed to write SOCKS5 connect reply: %v", err)
-		client.Close()
+	// Step 4: Carry out the command as the routing table says, usually through an
+	// agent whose result becomes the reply
+	r := routeForUser(target, userAgent)
+	if r.Action == "reject" {
+		rejectClient(client, r, target, socksReply)
 		return
 	}
-
-	// Only now start session/tunnel forwarding
-	sessID := rand.Uint32()
-	tunnelMu.Lock()
-	tunnelConnGlobal := tunnelConn
-	if tunnelConnGlobal == nil {
-		tunnelMu.Unlock()
-		logger.Error("No tunnel connection available for session %08x", sessID)
+	switch cmd {
+	case 0x01: // CONNECT
+		logger.Info("Request to %s", target)
+		connectRoute(client, r, target, socksReply)
+	case 0x02: // BIND
+		logger.Info("Bind request for %s", target)
+		if r.Action == "direct" {
+			// the proxy has no listener to offer for the target's network
+			logger.Error("Bind for %s is routed direct; only agents accept BIND", target)
+			client.Write(socksReply(socksRepCmdNotSupported, nil))
+			client.Close()
+			return
+		}
+		socksBind(client, r.Agent, target)
+	case 0x03: // UDP ASSOCIATE
+		logger.Info("UDP associate request from %v", client.RemoteAddr())
+		socksUDPAssociate(client, userAgent)
+	case 0xF0, 0xF1: // Tor RESOLVE and RESOLVE_PTR
+		logger.Info("Resolve request for %s", target)
+		socksResolve(client, r, cmd, target)
+	default:
+		logger.Error("Unsupported SOCKS5 command: %v", cmd)
+		client.Write(socksReply(socksRepCmdNotSupported, nil))
 		client.Close()
-		return
 	}
-	// Send session header and target string to tunnel BEFORE starting forwarding
-	header := make([]byte, 6)
-	binary.BigEndian.PutUint32(header[:4], sessID)
-	binary.BigEndian.PutUint16(header[4:], uint16(len(target)))
-	_, err = tunnelConnGlobal.Write(header)
-	if err != nil {
-		tunnelMu.Unlock()
-		logger.Error("Failed to write session header: %v", err)
+}
+
+// connectClient opens a tunnel session to target through agent, or the default
+// agent if empty, and pipes client through it.
+// reply builds the client protocol's reply from the agent's result; it may return
+// nil for clients that expect no reply.
+func connectClient(client net.Conn, agent, target string, reply func(rep byte, bound []byte) []byte) bool {
+	t, sessID, rep := openThroughTunnel(agent, openConnect, target, func(t *tunnel, sessID uint32, rep byte, bound []byte) byte {
+		return replyAndStart(t, sessID, client, rep, reply(rep, bound))
+	})
+	if rep != socksRepSucceeded {
+		logger.Error("session %08x connect to %s failed, reply code %#02x", sessID, target, rep)
 		client.Close()
-		return
+		return false
 	}
-	_, err = tunnelConnGlobal.Write([]byte(target))
+	logger.Info("session %08x connected to %s via %v", sessID, target, t.conn.RemoteAddr())
+	return true
+}
+
+// noReply is the reply builder for clients that expect no protocol reply
+func noReply(byte, []byte) []byte {
+	return nil
+}
+
+// completeFunc runs in the tunnel reader when the agent's open result arrives, or
+// with a failure code if the open cannot complete. It replies to the client and, on
+// success, registers the session before the next frame is read, so no target data
+// can reach the client ahead of the reply. It returns the final reply code.
+type completeFunc func(t *tunnel, sessID uint32, rep byte, bound []byte) byte
+
+// pendingConnect is a client waiting for the agent to report its open result
+type pendingConnect struct {
+	complete completeFunc
+	done     chan byte
+}
+
+// openThroughTunnel asks agent, or the default agent if empty, to open target with
+// cmd and waits for the result; complete handles the result as described for
+// completeFunc
+func openThroughTunnel(agent string, cmd byte, target string, complete completeFunc) (*tunnel, uint32, byte) {
+	sessID := newSessionID(false)
+	t, err := agentTunnel(agent)
 	if err != nil {
-		tunnelMu.Unlock()
-		logger.Error("Failed to write target string: %v", err)
-		client.Close()
-		return
+		logger.Error("No tunnel for session %08x: %v", sessID, err)
+		return nil, sessID, complete(nil, sessID, socksRepNetUnreachable, nil)
 	}
-	clientMu.Lock()
-	clientSess[sessID] = client
-	clientMu.Unlock()
-	tunnelMu.Unlock()
-	logger.Info("Tunnel connected from %v", tunnelConnGlobal.RemoteAddr())
-	go forwardClientToTunnel(tunnelConnGlobal, client, sessID)
+	return t, sessID, openOnTunnel(t, sessID, cmd, []byte(target), complete)
 }
 
-func writeFull(conn net.Conn, data []byte) error {
-	total := 0
-	for total < len(data) {
-		n, err := conn.Write(data[total:])
-		if err != nil {
-			return err
+// openOnTunnel sends frameOpen with cmd and args to the peer of t and waits for the
+// result; complete handles the result as described for completeFunc
+func openOnTunnel(t *tunnel, sessID uint32, cmd byte, args []byte, complete completeFunc) byte {
+	pc := &pendingConnect{complete: complete, done: make(chan byte, 1)}
+	if !t.addPending(sessID, pc) {
+		logger.Error("No tunnel connection available for session %08x", sessID)
+		return complete(nil, sessID, socksRepNetUnreachable, nil)
+	}
+	if err := t.send(frameOpen, sessID, append([]byte{cmd}, args...)); err != nil {
+		logger.Error("Failed to send open for session %08x: %v", sessID, err)
+		if t.takePending(sessID) != nil {
+			return complete(t, sessID, socksRepGeneralFailure, nil)
 		}
-		total += n
+		return <-pc.done
+	}
+	select {
+	case rep := <-pc.done:
+		return rep
+	case <-time.After(connectTimeout):
+		if t.takePending(sessID) == nil {
+			// the result raced the timeout; use it
+			return <-pc.done
+		}
+		logger.Error("session %08x timed out waiting for connect result", sessID)
+		t.send(frameReset, sessID, nil)
+		return complete(t, sessID, socksRepTTLExpired, nil)
 	}
-	return nil
 }
 
-func forwardClientToTunnel(dst net.Conn, src net.Conn, sessID uint32) {
-	buf := make([]byte, 4096)
-	header := make([]byte, 6)
-	binary.BigEndian.PutUint32(header[:4], sessID)
-	logger.Debug("tunnelConn pointer: %p, LocalAddr: %v, RemoteAddr: %v", dst, dst.LocalAddr(), dst.RemoteAddr())
-	errorCh := make(chan error, 1)
+// completeConnect hands the agent's open result to a pending client: payload is
+// REP | ATYP | BND.ADDR | BND.PORT, or nil if the tunnel failed first
+func completeConnect(t *tunnel, pc *pendingConnect, sessID uint32, payload []byte) {
+	rep := byte(socksRepGeneralFailure)
+	var bound []byte
+	if len(payload) > 0 {
+		rep, bound = payload[0], payload[1:]
+	}
+	pc.done <- pc.complete(t, sessID, rep, bound)
+}
 
-	// Forward src (SOCKS client) -> dst (tunnel)
-	go func() {
-		for {
-			logger.Debug("session %08x waiting to read from SOCKS client", sessID)
-			n, err := src.Read(buf)
-			if err != nil {
-				logger.Debug("session %08x closed by client", sessID)
-				errorCh <- err
-				return
+// replyAndStart writes the client protocol's reply and, if the open succeeded,
+// starts piping client through the session. reply may be nil for clients that
+// expect no reply.
+func replyAndStart(t *tunnel, sessID uint32, client net.Conn, rep byte, reply []byte) byte {
+	if reply != nil {
+		if _, err := client.Write(reply); err != nil {
+			logger.Error("Failed to write reply for session %08x: %v", sessID, err)
+			if rep == socksRepSucceeded {
+				t.send(frameReset, sessID, nil)
 			}
-			binary.BigEndian.PutUint16(header[4:], uint16(n))
-			logger.Debug("session %08x preparing to send %d bytes. Payload:\n%s", sessID, n, string(buf[:n]))
-			logger.Debug("Writing header+payload (%d bytes) to tunnel", n)
-			tunnelWriteMu.Lock()
-			if err = writeFull(dst, header); err != nil {
-				tunnelWriteMu.Unlock()
-				logger.Error("session %08x header+payload write failed: %v", sessID, err)
-				errorCh <- err
-				return
-			}
-			if err = writeFull(dst, buf[:n]); err != nil {
-				tunnelWriteMu.Unlock()
-				logger.Error("session %08x header+payload write failed: %v", sessID, err)
-				errorCh <- err
-				return
-			}
-			tunnelWriteMu.Unlock()
-			logger.Debug("session %08x wrote header and %d payload bytes to tunnel", sessID, n)
-		}
-	}()
-
-	// Wait for either direction to error/close
-	err := <-errorCh
-	logger.Info("session %08x closing, reason: %v", sessID, err)
-	// Do NOT close the shared tunnel connection here; only close the SOCKS client connection.
-	if src != nil {
-		logger.Debug("Closing SOCKS client %p", src)
-		err := src.Close()
-		if err != nil {
-			logger.Debug("Error closing SOCKS client: %v", err)
-		} else {
-			logger.Debug("SOCKS client closed successfully")
+			return socksRepGeneralFailure
 		}
 	}
-	clientMu.Lock()
-	delete(clientSess, sessID)
-	clientMu.Unlock()
+	if rep != socksRepSucceeded {
+		return rep
+	}
+	s := t.addSession(sessID, client)
+	if s == nil {
+		return socksRepGeneralFailure
+	}
+	s.start()
+	return rep
 }
 
-func handleTunnelReadsClient(tunnel net.Conn) {
-	header := make([]byte, 6)
-	for {
-		_, err := io.ReadFull(tunnel, header)
-		if err != nil {
-			logger.Println("Tunnel read error:", err)
-			return
+// handleTunnelReadsClient serves the proxy end of a tunnel until it fails
+func handleTunnelReadsClient(t *tunnel) {
+	err := t.readLoop(func(t *tunnel, f frame) {
+		switch f.typ {
+		case frameOpen:
+			openForwardedSession(t, f)
+		default:
+			logger.Error("Unexpected %s frame for session %08x", frameTypeName(f.typ), f.sessID)
 		}
-		sessID := binary.BigEndian.Uint32(header[:4])
-		length := binary.BigEndian.Uint16(header[4:6])
-		buf := make([]byte, length)
-		_, err = io.ReadFull(tunnel, buf)
-		if err != nil {
-			logger.Error("Payload read error for session %08x: %v", sessID, err)
-			return
-		}
-		clientMu.Lock()
-		client, ok := clientSess[sessID]
-		clientMu.Unlock()
-		if !ok {
-			logger.Error("Received data for unknown or closed session %08x", sessID)
-			continue
-		}
-		_, err = client.Write(buf)
-		if err != nil {
-			logger.Error("Write to SOCKS client for session %08x failed: %v", sessID, err)
-			clientMu.Lock()
-			delete(clientSess, sessID)
-			clientMu.Unlock()
-			_ = client.Close()
-		}
-	}
+	})
+	logger.Println("Tunnel read error:", err)
 }
 
 // RunProxyRelay registers with a relay and starts the SOCKS5 front-end using a secure tunnel
 func RunProxyRelay(relayAddr string, socksAddr string, secret string) {
+	socksListenAddr = socksAddr
 	logger.Info("Registering with relay %s", relayAddr)
-	rawConn, err := net.Dial("tcp", relayAddr)
+	rawConn, err := dialTunnel(relayAddr)
 	if err != nil {
 		logger.Fatalf("Register dial failed: %v", err)
 	}
@@ -341,28 +390,28 @@ func RunProxyRelay(relayAddr string, socksAddr string, secret string) {
 	if err != nil {
 		logger.Fatalf("Secure handshake failed: %v", err)
 	}
-	// set tunnel connection and start reader for agent replies
-	tunnelMu.Lock()
-	if tunnelConn != nil {
-		tunnelConn.Close()
+	name, group, err := identifyAgent(secureConn)
+	if err != nil {
+		logger.Fatalf("Agent did not introduce itself: %v", err)
 	}
-	tunnelConn = secureConn
-	tunnelMu.Unlock()
-	// start reading from tunnel and forwarding to SOCKS clients
-	go handleTunnelReadsClient(secureConn)
 	logger.Info("Tunnel via relay established")
+	registerAgent(name, group, newTunnel(secureConn))
+	if authorizedAgentsPath != "" {
+		go watchAuthorizedAgents()
+	}
+	startFrontends()
 	// start SOCKS5 proxy
 	ln, err := net.Listen("tcp", socksAddr)
 	if err != nil {
 		logger.Fatalf("SOCKS5 listen failed: %v", err)
 	}
-	logger.Info("SOCKS5 proxy listening on %s", socksAddr)
+	logger.Info("Proxy listening on %s (SOCKS5, SOCKS4, HTTP)", socksAddr)
 	for {
 		client, err := ln.Accept()
 		if err != nil {
 			logger.Println("Accept error:", err)
 			continue
 		}
-		go handleSOCKS(client)
+		go handleClient(client)
 	}
 }
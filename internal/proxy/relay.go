@@ -18,7 +18,7 @@ var (
 // RunRelay starts a relay server on the given port, accepting registrations and agent connections.
 func RunRelay(listenPort int, secret string) {
 	addr := fmt.Sprintf(":%d", listenPort)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := listenTunnel(addr)
 	if err != nil {
 		logger.Fatalf("Relay listen error: %v", err)
 	}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// socksResolve answers Tor's RESOLVE (0xF0) and RESOLVE_PTR (0xF1) extensions with a
+// lookup on r's agent, or on the proxy for direct routes: the reply's BND.ADDR is
+// the address or the name found. The connection closes after the reply.
+func socksResolve(client net.Conn, r route, cmd byte, target string) {
+	if r.Action == "direct" {
+		result, err := lookupForSOCKS(cmd, target)
+		if err != nil {
+			logger.Error("Direct resolve of %s failed: %v", target, err)
+		}
+		client.Write(socksReply(result[0], result[1:]))
+		client.Close()
+		return
+	}
+	_, sessID, rep := openThroughTunnel(r.Agent, cmd, target, func(_ *tunnel, sessID uint32, rep byte, bound []byte) byte {
+		if _, err := client.Write(socksReply(rep, bound)); err != nil {
+			logger.Error("Failed to write resolve reply for session %08x: %v", sessID, err)
+		}
+		return rep
+	})
+	if rep != socksRepSucceeded {
+		logger.Error("session %08x resolve of %s failed, reply code %#02x", sessID, target, rep)
+	}
+	client.Close()
+}
+
+// resolveForProxy looks up target for a RESOLVE or RESOLVE_PTR request and reports
+// the result as REP | ATYP | BND.ADDR | BND.PORT
+func resolveForProxy(t *tunnel, sessID uint32, cmd byte, target string) {
+	result, err := lookupForSOCKS(cmd, target)
+	if err != nil {
+		logger.Error("session %08x resolve of %s failed: %v", sessID, target, err)
+	} else {
+		logger.Info("session %08x resolved %s", sessID, target)
+	}
+	t.send(frameOpenResult, sessID, result)
+}
+
+// lookupForSOCKS resolves target's host, or the name of its address for
+// RESOLVE_PTR, with the local resolver and returns REP | ATYP | BND.ADDR | BND.PORT
+func lookupForSOCKS(cmd byte, target string) ([]byte, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return append([]byte{socksRepAddrNotSupported}, encodeSOCKSAddr(nil)...), err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	var result []byte
+	if cmd == openResolvePTR {
+		var names []string
+		if names, err = net.DefaultResolver.LookupAddr(ctx, host); err == nil && len(names) > 0 {
+			name := names[0]
+			if len(name) > 1 && name[len(name)-1] == '.' {
+				name = name[:len(name)-1]
+			}
+			if len(name) > 255 {
+				name = name[:255]
+			}
+			result = append([]byte{socksRepSucceeded, 0x03, byte(len(name))}, name...)
+			result = binary.BigEndian.AppendUint16(result, 0)
+		}
+	} else {
+		var ips []net.IP
+		if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err == nil && len(ips) > 0 {
+			// like Tor, prefer an IPv4 answer
+			ip := ips[0]
+			for _, candidate := range ips {
+				if candidate.To4() != nil {
+					ip = candidate
+					break
+				}
+			}
+			result = append([]byte{socksRepSucceeded}, encodeSOCKSAddr(&net.TCPAddr{IP: ip})...)
+		}
+	}
+	if result == nil {
+		rep := byte(socksRepHostUnreachable)
+		if err != nil {
+			rep = dialErrorReply(err)
+		} else {
+			err = errors.New("no answer")
+		}
+		return append([]byte{rep}, encodeSOCKSAddr(nil)...), err
+	}
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// reverseForwards are the reverse forwards requested from each agent that
+// connects, or only from the agent or group called Agent when set: the agent
+// listens on Remote and each accepted connection is tunnelled back to the proxy,
+// which dials Local
+var reverseForwards []Forward
+
+// SetReverseForwards asks each agent that connects to listen for fwds
+func SetReverseForwards(fwds []Forward) {
+	reverseForwards = fwds
+}
+
+// ParseReverseForward parses "remote=local[@agent]": the agent listens on remote,
+// an address or a bare port on 127.0.0.1, and the proxy dials local
+func ParseReverseForward(s string) (Forward, error) {
+	spec, agent := cutAgent(s)
+	remote, local, ok := strings.Cut(spec, "=")
+	if !ok {
+		return Forward{}, fmt.Errorf("invalid reverse forward %q: want remote=local", s)
+	}
+	f := Forward{Local: local, Remote: remote, Agent: agent}
+	return f, f.validateReverse()
+}
+
+// validateReverse checks the addresses, defaulting bare ports to 127.0.0.1
+func (f *Forward) validateReverse() error {
+	if !strings.Contains(f.Remote, ":") {
+		f.Remote = net.JoinHostPort("127.0.0.1", f.Remote)
+	}
+	if !strings.Contains(f.Local, ":") {
+		f.Local = net.JoinHostPort("127.0.0.1", f.Local)
+	}
+	if _, _, err := net.SplitHostPort(f.Remote); err != nil {
+		return fmt.Errorf("invalid reverse forward listen address %q: %v", f.Remote, err)
+	}
+	if _, _, err := net.SplitHostPort(f.Local); err != nil {
+		return fmt.Errorf("invalid reverse forward target %q: %v", f.Local, err)
+	}
+	return nil
+}
+
+// requestReverseForwards asks a newly connected agent to listen for every
+// configured reverse forward meant for it or its group
+func requestReverseForwards(a *agentConn) {
+	t := a.tunnel
+	for _, f := range reverseForwards {
+		if f.Agent != "" && f.Agent != a.name && f.Agent != a.group {
+			continue
+		}
+		if err := f.validateReverse(); err != nil {
+			logger.Error("%v", err)
+			continue
+		}
+		go requestReverseForward(t, f)
+	}
+}
+
+// requestReverseForward asks the agent to listen on f.Remote; connections it
+// accepts arrive as openForwarded sessions carrying the forward's ID
+func requestReverseForward(t *tunnel, f Forward) {
+	fwdID := newSessionID(false)
+	t.addReverseTarget(fwdID, f.Local)
+	rep := openOnTunnel(t, fwdID, openListen, []byte(f.Remote), func(t *tunnel, fwdID uint32, rep byte, bound []byte) byte {
+		if rep == socksRepSucceeded {
+			if addr, _, err := parseSOCKSAddr(bound); err == nil {
+				logger.Info("Agent listening on %s, forwarding to %s", addr, f.Local)
+			}
+		}
+		return rep
+	})
+	if rep != socksRepSucceeded {
+		logger.Error("Agent could not listen on %s for reverse forward to %s, reply code %#02x", f.Remote, f.Local, rep)
+		t.removeReverseTarget(fwdID)
+	}
+}
+
+// openForwardedSession dials the local target of a connection the agent accepted
+// for a reverse forward
+func openForwardedSession(t *tunnel, f frame) {
+	if len(f.payload) != 5 || f.payload[0] != openForwarded || f.sessID&agentSessionBit == 0 {
+		logger.Error("session %08x agent sent an unsupported open", f.sessID)
+		t.send(frameOpenResult, f.sessID, append([]byte{socksRepNotAllowed}, encodeSOCKSAddr(nil)...))
+		return
+	}
+	fwdID := binary.BigEndian.Uint32(f.payload[1:])
+	target := t.reverseTarget(fwdID)
+	if target == "" {
+		logger.Error("session %08x agent sent a connection for unknown reverse forward %08x", f.sessID, fwdID)
+		t.send(frameOpenResult, f.sessID, append([]byte{socksRepNotAllowed}, encodeSOCKSAddr(nil)...))
+		return
+	}
+	go openSession(t, f.sessID, target)
+}
+
+// openReverseListener listens on addr for the proxy and tunnels each accepted
+// connection back to it until the proxy resets the forward or the tunnel fails
+func openReverseListener(t *tunnel, fwdID uint32, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("Reverse forward listen on %s failed: %v", addr, err)
+		t.send(frameOpenResult, fwdID, append([]byte{dialErrorReply(err)}, encodeSOCKSAddr(nil)...))
+		return
+	}
+	if !t.addListener(fwdID, ln) {
+		ln.Close()
+		return
+	}
+	result := append([]byte{socksRepSucceeded}, encodeSOCKSAddr(ln.Addr())...)
+	if err := t.send(frameOpenResult, fwdID, result); err != nil {
+		if t.removeListener(fwdID) != nil {
+			ln.Close()
+		}
+		return
+	}
+	logger.Info("Reverse forward %08x listening on %v", fwdID, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if t.removeListener(fwdID) != nil {
+				ln.Close()
+				logger.Error("Reverse forward %08x accept failed: %v", fwdID, err)
+				t.send(frameReset, fwdID, nil)
+			} else {
+				logger.Info("Reverse forward %08x on %v closed", fwdID, ln.Addr())
+			}
+			return
+		}
+		go forwardToProxy(t, fwdID, conn)
+	}
+}
+
+// forwardToProxy opens a session for conn toward the proxy and pipes it through
+func forwardToProxy(t *tunnel, fwdID uint32, conn net.Conn) {
+	sessID := newSessionID(true)
+	logger.Info("session %08x reverse forward %08x accepted %v", sessID, fwdID, conn.RemoteAddr())
+	args := binary.BigEndian.AppendUint32(nil, fwdID)
+	rep := openOnTunnel(t, sessID, openForwarded, args, func(t *tunnel, sessID uint32, rep byte, _ []byte) byte {
+		return replyAndStart(t, sessID, conn, rep, nil)
+	})
+	if rep != socksRepSucceeded {
+		logger.Error("session %08x proxy could not connect reverse forward, reply code %#02x", sessID, rep)
+		conn.Close()
+	}
+}
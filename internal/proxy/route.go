@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// Route decides what happens to destinations matching Match: Action "agent" (the
+// default) tunnels them through the agent called Agent, "direct" has the proxy
+// connect to them itself and "reject" refuses them.
+//
+// Match is a domain ("corp.example" also covers its subdomains), a shell glob
+// ("*.corp-a.internal", "*"), an IP address or an IP network in CIDR notation,
+// optionally followed by ":port" ("10.2.0.0/16:5432", "[fd00::1]:22"). Domains
+// only match destinations given by name and addresses only match destinations
+// given by address, since the proxy does not resolve names; globs match either.
+type Route struct {
+	Match  string `yaml:"match"`
+	Agent  string `yaml:"agent"`
+	Action string `yaml:"action"` // "agent", "direct" or "reject"
+}
+
+// route is a parsed Route
+type route struct {
+	Route
+	domain  string
+	glob    string
+	network *net.IPNet
+	port    int // 0 matches any port
+}
+
+// routes are checked in order; the first match decides
+var routes []route
+
+// SetRoutes routes sessions by destination. Destinations matching no route go to
+// the default agent.
+func SetRoutes(rules []Route) error {
+	parsed := make([]route, 0, len(rules))
+	for _, r := range rules {
+		pr, err := parseRoute(r)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, pr)
+	}
+	routes = parsed
+	return nil
+}
+
+// parseRoute parses a route's match pattern
+func parseRoute(r Route) (route, error) {
+	pr := route{Route: r}
+	switch r.Action {
+	case "", "agent":
+		if r.Agent == "" {
+			return pr, fmt.Errorf("route %q has no agent", r.Match)
+		}
+		pr.Action = "agent"
+	case "direct", "reject":
+		if r.Agent != "" {
+			return pr, fmt.Errorf("route %q: agent %q needs action agent, not %q", r.Match, r.Agent, r.Action)
+		}
+	default:
+		return pr, fmt.Errorf("route %q: action must be agent, direct or reject, not %q", r.Match, r.Action)
+	}
+	pattern := strings.ToLower(r.Match)
+	if pattern == "" {
+		return pr, fmt.Errorf("route with action %q has no match", pr.Action)
+	}
+	// a bare IPv6 address or network has colons but no port
+	if !isIPOrCIDR(pattern) {
+		if i := strings.LastIndex(pattern, ":"); i >= 0 {
+			port, err := strconv.Atoi(pattern[i+1:])
+			if err != nil || port < 1 || port > 65535 {
+				return pr, fmt.Errorf("route %q: invalid port %q", r.Match, pattern[i+1:])
+			}
+			pr.port = port
+			pattern = strings.Trim(pattern[:i], "[]")
+		}
+	}
+	switch {
+	case strings.Contains(pattern, "/"):
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return pr, fmt.Errorf("route %q: %v", r.Match, err)
+		}
+		pr.network = network
+	case net.ParseIP(pattern) != nil:
+		ip := net.ParseIP(pattern)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		pr.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return pr, fmt.Errorf("route %q: %v", r.Match, err)
+		}
+		pr.glob = pattern
+	default:
+		pr.domain = strings.Trim(pattern, ".")
+	}
+	return pr, nil
+}
+
+func isIPOrCIDR(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// matches reports whether the route covers the destination host and port
+func (r *route) matches(host string, ip net.IP, port int) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	switch {
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case r.glob != "":
+		ok, _ := path.Match(r.glob, host)
+		return ok
+	default:
+		return ip == nil && (host == r.domain || strings.HasSuffix(host, "."+r.domain))
+	}
+}
+
+// agentRoute sends destinations to the agent or group called agent, or to the
+// default agent if empty
+func agentRoute(agent string) route {
+	return route{Route: Route{Agent: agent, Action: "agent"}}
+}
+
+// defaultRoute sends a destination to the default agent
+var defaultRoute = agentRoute("")
+
+// routeFor returns the first route matching target, or defaultRoute
+func routeFor(target string) route {
+	if len(routes) == 0 {
+		return defaultRoute
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return defaultRoute
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	port, _ := strconv.Atoi(portStr)
+	for i := range routes {
+		if routes[i].matches(host, ip, port) {
+			logger.Debug("Route %q matches %s: %s %s", routes[i].Match, target, routes[i].Action, routes[i].Agent)
+			return routes[i]
+		}
+	}
+	return defaultRoute
+}
+
+// routeForUser is routeFor for a client that may have picked an agent with its
+// username; that choice overrides the routing table unless the route rejects target
+// or no agent or group of that name is connected
+func routeForUser(target, agent string) route {
+	r := routeFor(target)
+	if agent == "" || r.Action == "reject" {
+		return r
+	}
+	if !agentConnected(agent) {
+		logger.Debug("Client picked agent %q for %s, which is not connected; routing normally", agent, target)
+		return r
+	}
+	logger.Debug("Client picked agent %q for %s", agent, target)
+	return agentRoute(agent)
+}
+
+// connectRoute connects client to target as r says: through r's agent, directly
+// from the proxy, or not at all. reply is as for connectClient.
+func connectRoute(client net.Conn, r route, target string, reply func(rep byte, bound []byte) []byte) bool {
+	switch r.Action {
+	case "reject":
+		rejectClient(client, r, target, reply)
+		return false
+	case "direct":
+		return connectDirect(client, target, reply)
+	}
+	return connectClient(client, r.Agent, target, reply)
+}
+
+// rejectClient refuses target with "not allowed by ruleset" and closes client
+func rejectClient(client net.Conn, r route, target string, reply func(rep byte, bound []byte) []byte) {
+	logger.Info("Route %q rejects %s", r.Match, target)
+	if msg := reply(socksRepNotAllowed, nil); msg != nil {
+		client.Write(msg)
+	}
+	client.Close()
+}
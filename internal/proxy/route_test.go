@@ -0,0 +1,113 @@
+package proxy
+
+import "testing"
+
+func TestRouteMatching(t *testing.T) {
+	tests := []struct {
+		match  string
+		target string
+		want   bool
+	}{
+		// globs match names and addresses alike
+		{"*.corp-a.internal", "db.corp-a.internal:5432", true},
+		{"*.corp-a.internal", "corp-a.internal:5432", false},
+		{"*.corp-a.internal", "db.corp-b.internal:5432", false},
+		{"*", "example.com:443", true},
+		{"*", "192.0.2.1:80", true},
+		{"*", "[2001:db8::1]:80", true},
+		{"10.*", "10.1.2.3:80", true},
+
+		// domains cover their subdomains, ignoring case and trailing dots
+		{"corp.example", "corp.example:80", true},
+		{"corp.example", "wiki.corp.example:443", true},
+		{"corp.example", "WIKI.Corp.Example.:443", true},
+		{"corp.example.", "wiki.corp.example:443", true},
+		{".corp.example", "corp.example:443", true},
+		{"corp.example", "notcorp.example:80", false},
+		{"corp.example", "corp.example.org:80", false},
+		{"10.0.0.1", "10.0.0.1.corp.example:80", false},
+
+		// addresses and networks only match destinations given by address
+		{"10.2.0.0/16", "10.2.255.1:22", true},
+		{"10.2.0.0/16", "10.3.0.1:22", false},
+		{"10.0.0.1", "10.0.0.1:80", true},
+		{"10.0.0.1", "10.0.0.2:80", false},
+		{"10.2.0.0/16", "db.10.2.0.0:22", false},
+
+		// cidr:port
+		{"10.2.0.0/16:5432", "10.2.3.4:5432", true},
+		{"10.2.0.0/16:5432", "10.2.3.4:5433", false},
+		{"10.2.0.0/16:5432", "10.9.3.4:5432", false},
+		{"corp.example:443", "www.corp.example:443", true},
+		{"corp.example:443", "www.corp.example:80", false},
+
+		// a bare IPv6 address or network has no port; a bracketed one may have one
+		{"fd00::1", "[fd00::1]:22", true},
+		{"fd00::1", "[fd00::1]:80", true},
+		{"fd00::1", "[fd00::2]:1", false},
+		{"fd00::/64", "[fd00::1234]:443", true},
+		{"fd00::/64", "[fd01::1]:443", false},
+		{"[fd00::1]:22", "[fd00::1]:22", true},
+		{"[fd00::1]:22", "[fd00::1]:80", false},
+		{"[fd00::1]:22", "[fd00::2]:22", false},
+	}
+	defer func() { routes = nil }()
+	for _, tt := range tests {
+		if err := SetRoutes([]Route{{Match: tt.match, Action: "reject"}}); err != nil {
+			t.Errorf("route %q: %v", tt.match, err)
+			continue
+		}
+		if got := routeFor(tt.target).Match == tt.match; got != tt.want {
+			t.Errorf("route %q matching %s = %v, want %v", tt.match, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestRouteOrder(t *testing.T) {
+	defer func() { routes = nil }()
+	err := SetRoutes([]Route{
+		{Match: "db.corp.example", Action: "reject"},
+		{Match: "corp.example", Agent: "site-a"},
+		{Match: "*", Action: "direct"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		action string
+		agent  string
+	}{
+		{"db.corp.example:5432", "reject", ""},
+		{"wiki.corp.example:443", "agent", "site-a"},
+		{"example.com:443", "direct", ""},
+	}
+	for _, tt := range tests {
+		r := routeFor(tt.target)
+		if r.Action != tt.action || r.Agent != tt.agent {
+			t.Errorf("%s routed to %s %q, want %s %q", tt.target, r.Action, r.Agent, tt.action, tt.agent)
+		}
+	}
+}
+
+func TestParseRouteErrors(t *testing.T) {
+	tests := []Route{
+		{Match: "corp.example:0", Agent: "a"},
+		{Match: "corp.example:65536", Agent: "a"},
+		{Match: "corp.example:https", Agent: "a"},
+		{Match: "[fd00::1]:", Agent: "a"},
+		{Match: "10.0.0.0/33", Agent: "a"},
+		{Match: "[*.corp", Agent: "a"},
+		{Match: "", Agent: "a"},
+		{Match: "corp.example"},
+		{Match: "corp.example", Action: "agent"},
+		{Match: "corp.example", Agent: "a", Action: "direct"},
+		{Match: "corp.example", Agent: "a", Action: "reject"},
+		{Match: "corp.example", Action: "bounce"},
+	}
+	for _, r := range tests {
+		if _, err := parseRoute(r); err == nil {
+			t.Errorf("parseRoute accepted match %q, agent %q, action %q", r.Match, r.Agent, r.Action)
+		}
+	}
+}
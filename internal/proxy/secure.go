@@ -1,110 +1,482 @@
 package proxy
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"slices"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
 )
 
 var errAuthFailed = errors.New("authentication failed")
 
-func deriveKey(secret string) []byte {
-	h := sha256.Sum256([]byte(secret))
-	return h[:]
+// handshakeTimeout bounds how long a peer has to complete the secure handshake
+const handshakeTimeout = 15 * time.Second
+
+const nonceSize = 32
+
+// x25519KeySize is the size of an ephemeral X25519 public key
+const x25519KeySize = 32
+
+// helloSize is the fixed prefix of both hellos: nonce | ephemeral public key
+const helloSize = nonceSize + x25519KeySize
+
+// Record cipher suites, in client preference order
+const (
+	suiteAES256GCM        = 0x01
+	suiteChaCha20Poly1305 = 0x02
+)
+
+var supportedSuites = []byte{suiteAES256GCM, suiteChaCha20Poly1305}
+
+// maxRecordSize is the largest plaintext carried by a single encrypted record
+const maxRecordSize = 16 * 1024
+
+// kdfSaltSize is the size of the salt the proxy sends for deriving the MAC key
+const kdfSaltSize = 16
+
+// scrypt cost parameters for deriving the handshake MAC key from the shared secret
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	kdfMu    sync.Mutex
+	kdfCache = make(map[string][]byte) // salt | secret -> MAC key
+
+	serverSaltOnce sync.Once
+	serverSalt     []byte
+)
+
+// proxySalt returns the random salt this process sends as the listening side of a
+// handshake; it stays the same for the life of the process
+func proxySalt() []byte {
+	serverSaltOnce.Do(func() {
+		serverSalt = make([]byte, kdfSaltSize)
+		if _, err := rand.Read(serverSalt); err != nil {
+			panic(err)
+		}
+	})
+	return serverSalt
 }
 
+// deriveKey stretches the shared secret into the handshake MAC key with scrypt, so
+// each guess at a secret behind a captured proof costs a full scrypt run. Keys are
+// cached per salt: the proxy derives its key once, an agent once per proxy start.
+func deriveKey(secret string, salt []byte) ([]byte, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	id := string(salt) + "\x00" + secret
+	kdfMu.Lock()
+	defer kdfMu.Unlock()
+	if key, ok := kdfCache[id]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key([]byte(secret), salt, scryptN, scryptR, scryptP, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	if len(kdfCache) >= 16 {
+		clear(kdfCache)
+	}
+	kdfCache[id] = key
+	return key, nil
+}
+
+// handshakeProof computes HMAC(key, role | transcript), proving knowledge of the
+// secret against both sides' fresh randomness
+func handshakeProof(key []byte, role string, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// Proofs that may follow a hello, announced by a leading flags byte
+const (
+	authHMAC      = 0x01 // HMAC(key, role | transcript)
+	authSignature = 0x02 // Ed25519 public key | signature over role | SHA-256(transcript)
+)
+
+// handshakeAuth holds the proofs a peer offered
+type handshakeAuth struct {
+	mac []byte
+	pub ed25519.PublicKey
+	sig []byte
+}
+
+func signedTranscript(role string, transcript []byte) []byte {
+	digest := sha256.Sum256(transcript)
+	return append([]byte(role), digest[:]...)
+}
+
+// buildAuth returns every proof this side can offer for role: an HMAC when a shared
+// secret is configured (macKey is non-nil) and a signature when an identity key is
+func buildAuth(macKey []byte, role string, transcript []byte) []byte {
+	out := []byte{0}
+	if macKey != nil {
+		out[0] |= authHMAC
+		out = append(out, handshakeProof(macKey, role, transcript)...)
+	}
+	if identityKey != nil {
+		out[0] |= authSignature
+		out = append(out, identityKey.Public().(ed25519.PublicKey)...)
+		out = append(out, ed25519.Sign(identityKey, signedTranscript(role, transcript))...)
+	}
+	return out
+}
+
+// readAuth reads the proofs written by buildAuth
+func readAuth(r io.Reader) (handshakeAuth, error) {
+	var auth handshakeAuth
+	var flags [1]byte
+	if _, err := io.ReadFull(r, flags[:]); err != nil {
+		return auth, err
+	}
+	if flags[0]&authHMAC != 0 {
+		auth.mac = make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, auth.mac); err != nil {
+			return auth, err
+		}
+	}
+	if flags[0]&authSignature != 0 {
+		buf := make([]byte, ed25519.PublicKeySize+ed25519.SignatureSize)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return auth, err
+		}
+		auth.pub, auth.sig = buf[:ed25519.PublicKeySize], buf[ed25519.PublicKeySize:]
+	}
+	return auth, nil
+}
+
+// verifyMAC checks the peer's proof of the shared secret
+func (a handshakeAuth) verifyMAC(macKey []byte, role string, transcript []byte) error {
+	if macKey == nil || a.mac == nil {
+		return fmt.Errorf("%w: peer did not offer a shared secret proof", errAuthFailed)
+	}
+	if !hmac.Equal(a.mac, handshakeProof(macKey, role, transcript)) {
+		return fmt.Errorf("%w: peer did not prove knowledge of the shared secret", errAuthFailed)
+	}
+	return nil
+}
+
+// verifySignature checks the peer's signature with the key it presented
+func (a handshakeAuth) verifySignature(role string, transcript []byte) error {
+	if a.sig == nil {
+		return fmt.Errorf("%w: peer did not sign the handshake with an identity key", errAuthFailed)
+	}
+	if !ed25519.Verify(a.pub, signedTranscript(role, transcript), a.sig) {
+		return fmt.Errorf("%w: invalid handshake signature from %s", errAuthFailed, EncodePublicKey(a.pub))
+	}
+	return nil
+}
+
+// newRecordAEAD derives the key for one direction of the connection from the
+// ephemeral X25519 shared secret and returns the negotiated AEAD keyed with it
+func newRecordAEAD(suite byte, shared, transcript []byte, direction string) (cipher.AEAD, error) {
+	salt := sha256.Sum256(transcript)
+	dirKey, err := hkdf.Key(sha256.New, shared, salt[:], "reverse-soxy "+direction, 32)
+	if err != nil {
+		return nil, err
+	}
+	switch suite {
+	case suiteAES256GCM:
+		block, err := aes.NewCipher(dirKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case suiteChaCha20Poly1305:
+		return chacha20poly1305.New(dirKey)
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %#02x", suite)
+	}
+}
+
+// secureConn carries data in AEAD-sealed records:
+//
+//	LENGTH (2) | CIPHERTEXT (LENGTH)
+//
+// The nonce of each record is its sequence number in that direction and the length
+// header is authenticated, so reordered, replayed or modified records fail to open.
 type secureConn struct {
 	net.Conn
-	r io.Reader
-	w io.Writer
+	enc, dec       cipher.AEAD
+	encSeq, decSeq uint64
+	plain          []byte            // decrypted bytes not yet returned by Read
+	peerName       string            // authorized agent name, when the peer used an identity key
+	peerKey        ed25519.PublicKey // the key that authorized the peer
+}
+
+// peerName returns the authorized agent name of a secured tunnel connection, or ""
+// if the agent authenticated with the shared secret
+func peerName(conn net.Conn) string {
+	if sc, ok := conn.(*secureConn); ok {
+		return sc.peerName
+	}
+	return ""
+}
+
+// peerKey returns the identity key that authorized the agent on a secured tunnel
+// connection, or nil if the agent authenticated with the shared secret
+func peerKey(conn net.Conn) ed25519.PublicKey {
+	if sc, ok := conn.(*secureConn); ok {
+		return sc.peerKey
+	}
+	return nil
+}
+
+func newSecureConn(conn net.Conn, suite byte, shared, transcript []byte, client bool) (*secureConn, error) {
+	c2s, err := newRecordAEAD(suite, shared, transcript, "client to server")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newRecordAEAD(suite, shared, transcript, "server to client")
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &secureConn{Conn: conn, enc: c2s, dec: s2c}, nil
+	}
+	return &secureConn{Conn: conn, enc: s2c, dec: c2s}, nil
+}
+
+func recordNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
 }
 
 func (s *secureConn) Read(p []byte) (int, error) {
-	return s.r.Read(p)
+	for len(s.plain) == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(s.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		record := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(s.Conn, record); err != nil {
+			return 0, err
+		}
+		plain, err := s.dec.Open(record[:0], recordNonce(s.dec, s.decSeq), record, hdr[:])
+		if err != nil {
+			s.Conn.Close()
+			return 0, fmt.Errorf("tunnel record %d failed authentication, dropping connection", s.decSeq)
+		}
+		s.decSeq++
+		s.plain = plain
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
 }
 
 func (s *secureConn) Write(p []byte) (int, error) {
-	return s.w.Write(p)
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxRecordSize)]
+		var hdr [2]byte
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(chunk)+s.enc.Overhead()))
+		record := s.enc.Seal(hdr[:], recordNonce(s.enc, s.encSeq), chunk, hdr[:])
+		if _, err := s.Conn.Write(record); err != nil {
+			return written, err
+		}
+		s.encSeq++
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// ephemeralShared completes the X25519 exchange with the peer's ephemeral public key
+func ephemeralShared(priv *ecdh.PrivateKey, peerPub []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ephemeral key: %w", err)
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %w", err)
+	}
+	return shared, nil
 }
 
-// NewSecureClientConn performs HMAC auth and AES-CTR encryption on a client-side tunnel connection
+// NewSecureClientConn performs an ephemeral X25519 key exchange authenticated by
+// mutual challenge-response on a client-side tunnel connection, negotiates a record
+// cipher and returns the encrypted connection:
+//
+//	client -> server: client nonce | client X25519 key | suite count | suites
+//	server -> client: server nonce | server X25519 key | chosen suite | KDF salt
+//	client -> server: client proofs
+//	server -> client: server proofs
+//
+// Proofs are an HMAC with a key derived from the shared secret and the server's
+// salt, and/or an Ed25519 signature by the peer's identity key (see buildAuth). The
+// connecting side proves itself first and the listener only answers with its proofs
+// once they check out, so reaching the tunnel port reveals nothing to test guessed
+// secrets against. The agent requires a signature by the pinned proxy key if one
+// is set, the proxy requires an authorized agent key if an authorized-agents file
+// is set; otherwise both require the shared secret.
+//
+// The transcript is every handshake byte before the proofs, so substituted keys or a
+// tampered suite list fail authentication. Record keys come from the ephemeral
+// exchange alone, so a later leak of the secret does not expose recorded traffic.
 func NewSecureClientConn(conn net.Conn, secret string) (net.Conn, error) {
-	key := deriveKey(secret)
-	// send HMAC handshake
-	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte("handshake"))
-	if _, err := conn.Write(mac.Sum(nil)); err != nil {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
 		return nil, err
 	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
+	clientHello := make([]byte, nonceSize, helloSize+1+len(supportedSuites))
+	if _, err := rand.Read(clientHello); err != nil {
+		return nil, err
+	}
+	clientHello = append(clientHello, eph.PublicKey().Bytes()...)
+	clientHello = append(clientHello, byte(len(supportedSuites)))
+	clientHello = append(clientHello, supportedSuites...)
+	if _, err := conn.Write(clientHello); err != nil {
 		return nil, err
 	}
-	// generate separate IVs for each direction
-	ivEnc := make([]byte, aes.BlockSize)
-	ivDec := make([]byte, aes.BlockSize)
-	if _, err := rand.Read(ivEnc); err != nil {
+	serverHello := make([]byte, helloSize+1+kdfSaltSize)
+	if _, err := io.ReadFull(conn, serverHello); err != nil {
+		return nil, fmt.Errorf("reading server challenge: %w", err)
+	}
+	serverPub, suite := serverHello[nonceSize:helloSize], serverHello[helloSize]
+	if !bytes.Contains(supportedSuites, []byte{suite}) {
+		return nil, fmt.Errorf("server chose unsupported cipher suite %#02x", suite)
+	}
+	shared, err := ephemeralShared(eph, serverPub)
+	if err != nil {
 		return nil, err
 	}
-	if _, err := rand.Read(ivDec); err != nil {
+	macKey, err := deriveKey(secret, serverHello[helloSize+1:])
+	if err != nil {
 		return nil, err
 	}
-	// send IVs: client->server encrypt IV then decrypt IV
-	if _, err := conn.Write(ivEnc); err != nil {
+	transcript := append(slices.Clone(clientHello), serverHello...)
+	if _, err := conn.Write(buildAuth(macKey, "client", transcript)); err != nil {
 		return nil, err
 	}
-	if _, err := conn.Write(ivDec); err != nil {
+	serverAuth, err := readAuth(conn)
+	if err != nil {
+		return nil, fmt.Errorf("server rejected authentication (secret or key mismatch?): %w", err)
+	}
+	if proxyPublicKey != nil {
+		if err := serverAuth.verifySignature("server", transcript); err != nil {
+			return nil, err
+		}
+		if !serverAuth.pub.Equal(proxyPublicKey) {
+			return nil, fmt.Errorf("%w: proxy key %s does not match the pinned key", errAuthFailed, EncodePublicKey(serverAuth.pub))
+		}
+	} else if err := serverAuth.verifyMAC(macKey, "server", transcript); err != nil {
 		return nil, err
 	}
 	// clear deadlines after handshake
 	conn.SetDeadline(time.Time{})
-	// create independent CTR streams
-	enc := cipher.NewCTR(block, ivEnc)
-	dec := cipher.NewCTR(block, ivDec)
-	return &secureConn{Conn: conn, r: cipher.StreamReader{S: dec, R: conn}, w: cipher.StreamWriter{S: enc, W: conn}}, nil
+	sc, err := newSecureConn(conn, suite, shared, transcript, true)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
 }
 
-// NewSecureServerConn performs HMAC auth and AES-CTR encryption on a server-side tunnel connection
+// NewSecureServerConn performs the authenticated key exchange on a server-side tunnel
+// connection; see NewSecureClientConn for the exchange
 func NewSecureServerConn(conn net.Conn, secret string) (net.Conn, error) {
-	key := deriveKey(secret)
-	// read HMAC handshake
-	expectedMacLen := sha256.Size
-	bufMac := make([]byte, expectedMacLen)
-	if _, err := io.ReadFull(conn, bufMac); err != nil {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	clientHello := make([]byte, helloSize+1)
+	if _, err := io.ReadFull(conn, clientHello); err != nil {
+		return nil, fmt.Errorf("reading client challenge: %w", err)
+	}
+	offered := make([]byte, clientHello[helloSize])
+	if _, err := io.ReadFull(conn, offered); err != nil {
+		return nil, fmt.Errorf("reading client cipher suites: %w", err)
+	}
+	clientHello = append(clientHello, offered...)
+	// pick the client's most preferred suite that we support
+	suite := byte(0)
+	for _, s := range offered {
+		if bytes.Contains(supportedSuites, []byte{s}) {
+			suite = s
+			break
+		}
+	}
+	if suite == 0 {
+		return nil, fmt.Errorf("no common cipher suite in client offer %x", offered)
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
 		return nil, err
 	}
-	mac := hmac.New(sha256.New, key)
-	mac.Write([]byte("handshake"))
-	if !hmac.Equal(bufMac, mac.Sum(nil)) {
-		return nil, errAuthFailed
+	shared, err := ephemeralShared(eph, clientHello[nonceSize:helloSize])
+	if err != nil {
+		return nil, err
 	}
-	// read IVs from client
-	ivEnc := make([]byte, aes.BlockSize)
-	ivDec := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(conn, ivEnc); err != nil {
+	salt := proxySalt()
+	macKey, err := deriveKey(secret, salt)
+	if err != nil {
 		return nil, err
 	}
-	if _, err := io.ReadFull(conn, ivDec); err != nil {
+	serverHello := make([]byte, nonceSize, helloSize+1+kdfSaltSize)
+	if _, err := rand.Read(serverHello); err != nil {
 		return nil, err
 	}
-	block, err := aes.NewCipher(key)
+	serverHello = append(serverHello, eph.PublicKey().Bytes()...)
+	serverHello = append(serverHello, suite)
+	serverHello = append(serverHello, salt...)
+	if _, err := conn.Write(serverHello); err != nil {
+		return nil, err
+	}
+	transcript := append(slices.Clone(clientHello), serverHello...)
+	clientAuth, err := readAuth(conn)
 	if err != nil {
+		return nil, fmt.Errorf("reading client proof: %w", err)
+	}
+	name, key := "", ed25519.PublicKey(nil)
+	if authorizedAgentsPath != "" {
+		if err := clientAuth.verifySignature("client", transcript); err != nil {
+			return nil, err
+		}
+		if name, err = lookupAuthorizedAgent(clientAuth.pub); err != nil {
+			return nil, err
+		}
+		key = clientAuth.pub
+	} else if err := clientAuth.verifyMAC(macKey, "client", transcript); err != nil {
 		return nil, err
 	}
-	// create independent CTR streams: decrypt client->server using ivEnc, encrypt server->client using ivDec
-	dec := cipher.NewCTR(block, ivEnc)
-	enc := cipher.NewCTR(block, ivDec)
+	// only a client that proved itself gets our proofs
+	if _, err := conn.Write(buildAuth(macKey, "server", transcript)); err != nil {
+		return nil, err
+	}
+	// clear deadlines after handshake
+	conn.SetDeadline(time.Time{})
 	// disable Nagle on underlying TCP
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		tcpConn.SetNoDelay(true)
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 	}
-	return &secureConn{Conn: conn, r: cipher.StreamReader{S: dec, R: conn}, w: cipher.StreamWriter{S: enc, W: conn}}, nil
+	sc, err := newSecureConn(conn, suite, shared, transcript, false)
+	if err != nil {
+		return nil, err
+	}
+	sc.peerName, sc.peerKey = name, key
+	return sc, nil
 }
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordPair returns a writing and a reading secureConn for suite with the raw
+// ciphertext between them exposed: records written to w arrive on wireOut, and
+// bytes written to wireIn are read by r
+func recordPair(t *testing.T, suite byte) (w *secureConn, wireOut net.Conn, r *secureConn, wireIn net.Conn) {
+	t.Helper()
+	shared := bytes.Repeat([]byte{0x5A}, 32)
+	transcript := []byte("test transcript")
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	w, err := newSecureConn(a1, suite, shared, transcript, true)
+	if err != nil {
+		t.Fatalf("suite %#02x: %v", suite, err)
+	}
+	r, err = newSecureConn(b1, suite, shared, transcript, false)
+	if err != nil {
+		t.Fatalf("suite %#02x: %v", suite, err)
+	}
+	t.Cleanup(func() {
+		a1.Close()
+		a2.Close()
+		b1.Close()
+		b2.Close()
+	})
+	return w, a2, r, b2
+}
+
+// readRecord reads one raw record, header included, off the wire
+func readRecord(t *testing.T, wire net.Conn) []byte {
+	t.Helper()
+	wire.SetReadDeadline(time.Now().Add(time.Second))
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(wire, hdr); err != nil {
+		t.Fatalf("reading record header: %v", err)
+	}
+	record := make([]byte, binary.BigEndian.Uint16(hdr))
+	if _, err := io.ReadFull(wire, record); err != nil {
+		t.Fatalf("reading record: %v", err)
+	}
+	return append(hdr, record...)
+}
+
+// sendRecord writes msg through w and returns the record it produced
+func sendRecord(t *testing.T, w *secureConn, wireOut net.Conn, msg []byte) []byte {
+	t.Helper()
+	go w.Write(msg)
+	return readRecord(t, wireOut)
+}
+
+// expectDropped checks that r rejects the bytes on the wire and closes its connection
+func expectDropped(t *testing.T, r *secureConn, wireIn net.Conn, record []byte) {
+	t.Helper()
+	go wireIn.Write(record)
+	if _, err := r.Read(make([]byte, 64)); err == nil {
+		t.Fatal("corrupt record was accepted")
+	}
+	wireIn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := wireIn.Write([]byte{0}); err != io.ErrClosedPipe {
+		t.Fatalf("connection still open after a corrupt record: write returned %v", err)
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	for _, suite := range supportedSuites {
+		w, wireOut, r, wireIn := recordPair(t, suite)
+		// larger than one record, so it is split and reassembled
+		want := bytes.Repeat([]byte("record"), maxRecordSize/2)
+		go func() {
+			w.Write(want)
+			w.Close()
+		}()
+		go io.Copy(wireIn, wireOut)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("suite %#02x: %v", suite, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("suite %#02x: data corrupted in transit", suite)
+		}
+	}
+}
+
+func TestRecordBitFlipDropsConnection(t *testing.T) {
+	for _, suite := range supportedSuites {
+		w, wireOut, r, wireIn := recordPair(t, suite)
+		record := sendRecord(t, w, wireOut, []byte("hello"))
+		record[len(record)-1] ^= 0x01
+		expectDropped(t, r, wireIn, record)
+	}
+}
+
+func TestRecordReplayDropsConnection(t *testing.T) {
+	for _, suite := range supportedSuites {
+		w, wireOut, r, wireIn := recordPair(t, suite)
+		record := sendRecord(t, w, wireOut, []byte("hello"))
+		go wireIn.Write(record)
+		buf := make([]byte, 64)
+		n, err := r.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("suite %#02x: first copy of the record: %q, %v", suite, buf[:n], err)
+		}
+		expectDropped(t, r, wireIn, record)
+	}
+}
+
+// handshake runs both sides of the secure handshake over conns, closing a side's
+// connection when its handshake fails as the callers do
+func handshake(clientSecret, serverSecret string, clientConn, serverConn net.Conn) (client, server net.Conn, clientErr, serverErr error) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if server, serverErr = NewSecureServerConn(serverConn, serverSecret); serverErr != nil {
+			serverConn.Close()
+		}
+	}()
+	if client, clientErr = NewSecureClientConn(clientConn, clientSecret); clientErr != nil {
+		clientConn.Close()
+	}
+	<-done
+	return client, server, clientErr, serverErr
+}
+
+// testIdentity sets an identity key for the test and returns its public key
+func testIdentity(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityKey = priv
+	t.Cleanup(func() { identityKey = nil })
+	return pub
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client, server, clientErr, serverErr := handshake("s3", "s3", c1, c2)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q, %v", buf, err)
+	}
+}
+
+func TestHandshakeServerRejectsWrongSecret(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, _, clientErr, serverErr := handshake("guess", "s3", c1, c2)
+	if !errors.Is(serverErr, errAuthFailed) {
+		t.Fatalf("server accepted a wrong secret: %v", serverErr)
+	}
+	if clientErr == nil {
+		t.Fatal("client completed a handshake the server rejected")
+	}
+}
+
+func TestHandshakeClientRejectsWrongSecret(t *testing.T) {
+	// the proxy accepts the agent by key, so only the agent checks the secret
+	pub := testIdentity(t)
+	path := filepath.Join(t.TempDir(), "authorized_agents")
+	if err := os.WriteFile(path, []byte("agent-1 "+EncodePublicKey(pub)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authorizedAgentsPath = path
+	t.Cleanup(func() { authorizedAgentsPath = "" })
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, _, clientErr, serverErr := handshake("s3", "other", c1, c2)
+	if serverErr != nil {
+		t.Fatalf("server rejected an authorized key: %v", serverErr)
+	}
+	if !errors.Is(clientErr, errAuthFailed) {
+		t.Fatalf("client accepted a server with a different secret: %v", clientErr)
+	}
+}
+
+func TestHandshakeRejectsTamperedSuites(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s1, s2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	defer s1.Close()
+	defer s2.Close()
+	// a man in the middle reorders the offer to force the client's less preferred suite
+	go func() {
+		hello := make([]byte, helloSize+1+len(supportedSuites))
+		if _, err := io.ReadFull(c2, hello); err != nil {
+			return
+		}
+		suites := hello[helloSize+1:]
+		suites[0], suites[1] = suites[1], suites[0]
+		s1.Write(hello)
+		go io.Copy(s1, c2)
+		io.Copy(c2, s1)
+		c2.Close()
+	}()
+	_, _, clientErr, serverErr := handshake("s3", "s3", c1, s2)
+	if !errors.Is(serverErr, errAuthFailed) {
+		t.Fatalf("server accepted a tampered suite list: %v", serverErr)
+	}
+	if clientErr == nil {
+		t.Fatal("client completed a handshake with a tampered suite list")
+	}
+}
+
+func TestHandshakeRejectsWrongPinnedKey(t *testing.T) {
+	testIdentity(t)
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyPublicKey = other
+	t.Cleanup(func() { proxyPublicKey = nil })
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, _, clientErr, _ := handshake("s3", "s3", c1, c2)
+	if !errors.Is(clientErr, errAuthFailed) {
+		t.Fatalf("client accepted a proxy key other than the pinned one: %v", clientErr)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SOCKS5 reply codes (RFC 1928, section 6)
+const (
+	socksRepSucceeded        = 0x00
+	socksRepGeneralFailure   = 0x01
+	socksRepNotAllowed       = 0x02
+	socksRepNetUnreachable   = 0x03
+	socksRepHostUnreachable  = 0x04
+	socksRepConnRefused      = 0x05
+	socksRepTTLExpired       = 0x06
+	socksRepCmdNotSupported  = 0x07
+	socksRepAddrNotSupported = 0x08
+)
+
+// dialErrorReply maps a dial error to the closest SOCKS5 reply code
+func dialErrorReply(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return socksRepSucceeded
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksRepConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksRepNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksRepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksRepTTLExpired
+	default:
+		return socksRepGeneralFailure
+	}
+}
+
+// encodeSOCKSAddr encodes addr as ATYP | ADDR | PORT; unknown addresses encode as 0.0.0.0:0
+func encodeSOCKSAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	var buf []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{0x01}, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		buf = append([]byte{0x04}, ip16...)
+	} else {
+		buf = []byte{0x01, 0, 0, 0, 0}
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// parseSOCKSAddr decodes ATYP | ADDR | PORT at the start of b into "host:port" and
+// returns the number of bytes consumed
+func parseSOCKSAddr(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, errors.New("short SOCKS address")
+	}
+	var host string
+	n := 1
+	switch b[0] {
+	case 0x01:
+		n += net.IPv4len
+		if len(b) < n+2 {
+			return "", 0, errors.New("short SOCKS IPv4 address")
+		}
+		host = net.IP(b[1:n]).String()
+	case 0x03:
+		if len(b) < 2 {
+			return "", 0, errors.New("short SOCKS domain address")
+		}
+		n += 1 + int(b[1])
+		if len(b) < n+2 {
+			return "", 0, errors.New("short SOCKS domain address")
+		}
+		host = string(b[2:n])
+	case 0x04:
+		n += net.IPv6len
+		if len(b) < n+2 {
+			return "", 0, errors.New("short SOCKS IPv6 address")
+		}
+		host = net.IP(b[1:n]).String()
+	default:
+		return "", 0, fmt.Errorf("unsupported SOCKS address type %#02x", b[0])
+	}
+	port := binary.BigEndian.Uint16(b[n : n+2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n + 2, nil
+}
+
+// socksReply builds a SOCKS5 reply from a reply code and an encoded bound address
+func socksReply(rep byte, bound []byte) []byte {
+	if len(bound) == 0 {
+		bound = encodeSOCKSAddr(nil)
+	}
+	return append([]byte{0x05, rep, 0x00}, bound...)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// SOCKS4 reply codes
+const (
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+)
+
+// handleSOCKS4 serves a SOCKS4 or SOCKS4a CONNECT request whose first bytes have
+// already been read into head:
+//
+//	VN (1) | CD (1) | DSTPORT (2) | DSTIP (4) | USERID | NUL [| HOST | NUL]
+//
+// A DSTIP of 0.0.0.x with x != 0 means SOCKS4a: the agent resolves HOST.
+func handleSOCKS4(client net.Conn, head []byte) {
+	r := io.MultiReader(bytes.NewReader(head), client)
+	req := make([]byte, 8)
+	if _, err := io.ReadFull(r, req); err != nil {
+		logger.Error("SOCKS4 request read failed: %v", err)
+		client.Close()
+		return
+	}
+	user, err := readNulString(r)
+	if err != nil {
+		logger.Error("SOCKS4 user ID read failed: %v", err)
+		client.Close()
+		return
+	}
+	host := net.IP(req[4:8]).String()
+	if req[4] == 0 && req[5] == 0 && req[6] == 0 && req[7] != 0 {
+		if host, err = readNulString(r); err != nil || host == "" {
+			logger.Error("SOCKS4a hostname read failed: %v", err)
+			client.Close()
+			return
+		}
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(req[2:4]))))
+
+	if socksCredentials != nil {
+		// SOCKS4 carries no password, so it cannot satisfy username/password auth
+		logger.Error("Rejecting SOCKS4 client %v (user %q): authentication is required", client.RemoteAddr(), user)
+		client.Write(socks4Reply(socksRepNotAllowed, nil))
+		client.Close()
+		return
+	}
+	if req[1] != 0x01 {
+		logger.Error("Unsupported SOCKS4 command: %v", req[1])
+		client.Write(socks4Reply(socksRepCmdNotSupported, nil))
+		client.Close()
+		return
+	}
+	logger.Info("SOCKS4 request to %s", target)
+	connectRoute(client, routeFor(target), target, socks4Reply)
+}
+
+// socks4Reply builds a SOCKS4 reply; every SOCKS5 failure maps to "rejected"
+func socks4Reply(rep byte, _ []byte) []byte {
+	cd := byte(socks4Granted)
+	if rep != socksRepSucceeded {
+		cd = socks4Rejected
+	}
+	return []byte{0x00, cd, 0, 0, 0, 0, 0, 0}
+}
+
+// readNulString reads a NUL-terminated string of at most 255 bytes one byte at a
+// time, so nothing after the terminator is consumed
+func readNulString(r io.Reader) (string, error) {
+	var b [1]byte
+	var s []byte
+	for len(s) < 256 {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		s = append(s, b[0])
+	}
+	return "", errors.New("string too long")
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net"
+	"runtime"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// transparentListenAddr enables the transparent proxy listener when set
+var transparentListenAddr string
+
+// SetTransparentListenAddr accepts connections redirected by iptables or nftables
+// (REDIRECT) on addr and tunnels each to its original destination. Linux only.
+func SetTransparentListenAddr(addr string) {
+	transparentListenAddr = addr
+}
+
+// startTransparentListener accepts redirected connections on transparentListenAddr
+func startTransparentListener() {
+	if runtime.GOOS != "linux" {
+		logger.Fatal("Transparent proxying requires Linux")
+	}
+	ln, err := net.Listen("tcp", transparentListenAddr)
+	if err != nil {
+		logger.Fatalf("Transparent proxy listen failed: %v", err)
+	}
+	logger.Info("Transparent proxy listening on %s", transparentListenAddr)
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			logger.Println("Accept error:", err)
+			continue
+		}
+		go handleTransparent(client)
+	}
+}
+
+// handleTransparent tunnels a redirected connection to its original destination
+func handleTransparent(client net.Conn) {
+	dst, err := originalDst(client)
+	if err != nil {
+		logger.Error("Cannot recover original destination of %v: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+	if dst.String() == client.LocalAddr().String() {
+		// not redirected: connecting to ourselves would loop through the tunnel
+		logger.Error("Connection from %v to %v was not redirected, dropping", client.RemoteAddr(), dst)
+		client.Close()
+		return
+	}
+	logger.Info("Transparent request from %v to %v", client.RemoteAddr(), dst)
+	connectRoute(client, routeFor(dst.String()), dst.String(), noReply)
+}
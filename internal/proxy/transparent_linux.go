@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSOOriginalDst is IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+const ip6tSOOriginalDst = 80
+
+// originalDst returns the destination a REDIRECTed connection was addressed to
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in the 32-byte IPv6MTUInfo, the usual way to read it
+			var info *unix.IPv6MTUInfo
+			info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSOOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+			return
+		}
+		// sockaddr_in fits in the 16-byte IPv6Mreq
+		var mreq *unix.IPv6Mreq
+		mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if sockErr != nil {
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
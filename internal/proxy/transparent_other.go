@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst is only available with Linux netfilter
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxying requires Linux")
+}
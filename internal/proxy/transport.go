@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSOptions configures the optional TLS 1.3 transport for tunnel and relay
+// connections. The secure handshake still runs inside TLS, so agents authenticate
+// with the shared secret or their identity key exactly as over plain TCP.
+type TLSOptions struct {
+	CertFile   string // our certificate; required when listening
+	KeyFile    string // private key for CertFile
+	CAFile     string // CA bundle used to verify the peer instead of the system roots
+	ClientAuth bool   // listener: require and verify client certificates (mTLS)
+	PinSHA256  string // hex SHA-256 fingerprint the peer's leaf certificate must match
+	ServerName string // dialer: name to verify instead of the dialed host
+}
+
+// tlsOptions enables the TLS transport when set
+var tlsOptions *TLSOptions
+
+// SetTLS switches tunnel and relay connections to the TLS transport
+func SetTLS(opts TLSOptions) {
+	tlsOptions = &opts
+}
+
+// listenTunnel listens for tunnel or relay connections on addr, over TLS if enabled
+func listenTunnel(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || tlsOptions == nil {
+		return ln, err
+	}
+	cfg, err := tlsOptions.config(true)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, cfg), nil
+}
+
+// dialTunnel dials a proxy or relay, over TLS if enabled, with TCP keepalives on
+func dialTunnel(addr string) (net.Conn, error) {
+	rawConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := rawConn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	}
+	if tlsOptions == nil {
+		return rawConn, nil
+	}
+	cfg, err := tlsOptions.config(false)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	conn := tls.Client(rawConn, cfg)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// config builds the crypto/tls configuration for a listener or a dialer
+func (o *TLSOptions) config(server bool) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS13, ServerName: o.ServerName}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	} else if server {
+		return nil, errors.New("TLS transport requires a certificate and key to listen")
+	}
+	var pool *x509.CertPool
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", o.CAFile)
+		}
+	}
+	var pin []byte
+	if o.PinSHA256 != "" {
+		var err error
+		pin, err = hex.DecodeString(strings.ReplaceAll(o.PinSHA256, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %q: want a hex SHA-256 fingerprint", o.PinSHA256)
+		}
+	}
+
+	if server {
+		if o.ClientAuth {
+			if pool == nil && pin == nil {
+				// a nil ClientCAs would accept any certificate the system roots trust
+				return nil, errors.New("TLS client authentication requires a CA file or certificate pin to check clients against")
+			}
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			cfg.ClientCAs = pool
+			if pool == nil && pin != nil {
+				// the pin alone identifies the client
+				cfg.ClientAuth = tls.RequireAnyClientCert
+			}
+		}
+	} else {
+		cfg.RootCAs = pool
+		if pool == nil && pin != nil {
+			// the pin replaces chain verification; VerifyConnection checks it below
+			cfg.InsecureSkipVerify = true
+		}
+	}
+	if pin != nil {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				if server && !o.ClientAuth {
+					return nil
+				}
+				return errors.New("peer presented no certificate to check against the pin")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("peer certificate fingerprint %x does not match the pin", sum)
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
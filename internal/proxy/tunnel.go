@@ -0,0 +1,552 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// keepaliveInterval is how often each end pings the tunnel; the proxy uses the
+// replies to measure agent latency and health
+const keepaliveInterval = 10 * time.Second
+
+// pongTimeout is how long a ping may go unanswered before the tunnel counts as
+// unhealthy, so a silently dropped agent leaves group rotation within
+// keepaliveInterval+pongTimeout
+const pongTimeout = 5 * time.Second
+
+// initialWindow is how many bytes each side of a session may have in flight before
+// the receiver grants more credit with frameWindow
+const initialWindow = 256 * 1024
+
+// windowUpdateThreshold is how many bytes a receiver consumes before sending credit
+const windowUpdateThreshold = initialWindow / 4
+
+// agentSessionBit is set in the IDs of sessions the agent opens, so they never
+// collide with IDs chosen by the proxy
+const agentSessionBit = 1 << 31
+
+// newSessionID picks a random ID for a session opened by the proxy or the agent
+func newSessionID(agent bool) uint32 {
+	if agent {
+		return rand.Uint32() | agentSessionBit
+	}
+	return rand.Uint32() &^ agentSessionBit
+}
+
+// tunnel is one secured connection carrying multiplexed sessions. The proxy and the
+// agent each wrap their end of the connection in a tunnel.
+type tunnel struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	done    chan struct{}
+
+	mu        sync.Mutex
+	closed    bool
+	sessions  map[uint32]*session
+	pending   map[uint32]*pendingConnect
+	datagrams map[uint32]datagramSession
+	listeners map[uint32]net.Listener
+	reverse   map[uint32]string // reverse forward ID -> local target, on the proxy
+	rtt       time.Duration     // round trip of the latest keepalive, 0 until measured
+	lastPing  time.Time
+	lastPong  time.Time
+}
+
+// datagramSession is the local end of a UDP association carried by frameDatagram
+type datagramSession interface {
+	// deliverDatagram handles a frameDatagram payload; it must not block
+	deliverDatagram(payload []byte)
+	// closeDatagram tears the association down after a reset or tunnel failure
+	closeDatagram()
+}
+
+func newTunnel(conn net.Conn) *tunnel {
+	return &tunnel{
+		conn:      conn,
+		done:      make(chan struct{}),
+		sessions:  make(map[uint32]*session),
+		pending:   make(map[uint32]*pendingConnect),
+		datagrams: make(map[uint32]datagramSession),
+		listeners: make(map[uint32]net.Listener),
+		reverse:   make(map[uint32]string),
+		lastPong:  time.Now(),
+	}
+}
+
+// send writes a single frame to the tunnel
+func (t *tunnel) send(typ byte, sessID uint32, payload []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return writeFrame(t.conn, typ, sessID, payload)
+}
+
+// frameHandler handles the frame types that differ between proxy and agent
+type frameHandler func(t *tunnel, f frame)
+
+// readLoop dispatches incoming frames until the tunnel fails, then closes it
+func (t *tunnel) readLoop(handle frameHandler) error {
+	defer t.close()
+	for {
+		f, err := readFrame(t.conn)
+		if err != nil {
+			return err
+		}
+		logger.Debug("session %08x received %s frame (%d bytes)", f.sessID, frameTypeName(f.typ), len(f.payload))
+		switch f.typ {
+		case frameOpenResult:
+			if pc := t.takePending(f.sessID); pc != nil {
+				completeConnect(t, pc, f.sessID, f.payload)
+			} else {
+				// the opener gave up waiting; tell the peer to drop the session
+				t.send(frameReset, f.sessID, nil)
+			}
+		case frameData:
+			if s := t.session(f.sessID); s != nil {
+				s.deliver(f.payload)
+			} else {
+				logger.Debug("Received data for unknown or closed session %08x, resetting", f.sessID)
+				t.send(frameReset, f.sessID, nil)
+			}
+		case frameHalfClose:
+			if s := t.session(f.sessID); s != nil {
+				s.remoteHalfClose()
+			} else {
+				t.send(frameReset, f.sessID, nil)
+			}
+		case frameReset:
+			if s := t.session(f.sessID); s != nil {
+				logger.Debug("session %08x reset by peer", f.sessID)
+				s.abort(false)
+			} else if d := t.removeDatagramSession(f.sessID); d != nil {
+				logger.Debug("UDP association %08x reset by peer", f.sessID)
+				d.closeDatagram()
+			} else if ln := t.removeListener(f.sessID); ln != nil {
+				logger.Debug("session %08x bind cancelled by peer", f.sessID)
+				ln.Close()
+			}
+		case frameDatagram:
+			if d := t.datagramSession(f.sessID); d != nil {
+				d.deliverDatagram(f.payload)
+			} else {
+				t.send(frameReset, f.sessID, nil)
+			}
+		case framePing:
+			t.send(framePong, f.sessID, f.payload)
+		case framePong:
+			t.recordPong(f.payload)
+		case frameWindow:
+			if s := t.session(f.sessID); s != nil && len(f.payload) == 4 {
+				s.addCredit(int(binary.BigEndian.Uint32(f.payload)))
+			}
+		default:
+			handle(t, f)
+		}
+	}
+}
+
+// keepalive pings the peer now and periodically until the tunnel is closed
+func (t *tunnel) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.ping(); err != nil {
+			logger.Debug("Keepalive ping failed: %v", err)
+			t.conn.Close()
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// ping sends a keepalive carrying its send time, which the peer echoes back in the pong
+func (t *tunnel) ping() error {
+	now := time.Now()
+	t.mu.Lock()
+	t.lastPing = now
+	t.mu.Unlock()
+	return t.send(framePing, 0, binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano())))
+}
+
+// recordPong notes a keepalive reply and the round trip time it carries
+func (t *tunnel) recordPong(payload []byte) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastPong = now
+	if len(payload) == 8 {
+		t.rtt = now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(payload))))
+	}
+}
+
+// health reports whether the tunnel is open and answered its latest keepalive
+// within pongTimeout, along with its latest round trip time and how many sessions
+// it carries
+func (t *tunnel) health() (healthy bool, rtt time.Duration, load int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	missed := t.lastPing.After(t.lastPong) && time.Since(t.lastPing) > pongTimeout
+	healthy = !t.closed && !missed
+	return healthy, t.rtt, len(t.sessions) + len(t.pending) + len(t.datagrams)
+}
+
+// close shuts the tunnel down and aborts every session and pending connect on it
+func (t *tunnel) close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.done)
+	sessions := make([]*session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	pending := t.pending
+	t.pending = make(map[uint32]*pendingConnect)
+	datagrams := t.datagrams
+	t.datagrams = make(map[uint32]datagramSession)
+	listeners := t.listeners
+	t.listeners = make(map[uint32]net.Listener)
+	t.mu.Unlock()
+
+	t.conn.Close()
+	for _, s := range sessions {
+		s.abort(false)
+	}
+	for _, d := range datagrams {
+		d.closeDatagram()
+	}
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for sessID, pc := range pending {
+		completeConnect(t, pc, sessID, nil)
+	}
+}
+
+func (t *tunnel) session(sessID uint32) *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[sessID]
+}
+
+// addSession registers a session for conn; frames for it are buffered until start.
+// It returns nil if the tunnel has already been closed.
+func (t *tunnel) addSession(sessID uint32, conn net.Conn) *session {
+	s := &session{
+		id:         sessID,
+		tunnel:     t,
+		conn:       conn,
+		sendWindow: initialWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.sessions[sessID] = s
+	return s
+}
+
+func (t *tunnel) removeSession(sessID uint32) {
+	t.mu.Lock()
+	delete(t.sessions, sessID)
+	t.mu.Unlock()
+}
+
+// addDatagramSession registers a UDP association; it returns false if the tunnel
+// has already been closed
+func (t *tunnel) addDatagramSession(sessID uint32, d datagramSession) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.datagrams[sessID] = d
+	return true
+}
+
+func (t *tunnel) datagramSession(sessID uint32) datagramSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.datagrams[sessID]
+}
+
+// removeDatagramSession unregisters and returns a UDP association, or nil if it
+// was already removed
+func (t *tunnel) removeDatagramSession(sessID uint32) datagramSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.datagrams[sessID]
+	delete(t.datagrams, sessID)
+	return d
+}
+
+// addListener registers a listener still waiting to accept a session's connection,
+// so a reset or tunnel failure closes it; it returns false if the tunnel has
+// already been closed
+func (t *tunnel) addListener(sessID uint32, ln net.Listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.listeners[sessID] = ln
+	return true
+}
+
+// removeListener unregisters and returns a session's listener, or nil if it was
+// already removed; whoever removes it owns closing it
+func (t *tunnel) removeListener(sessID uint32) net.Listener {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ln := t.listeners[sessID]
+	delete(t.listeners, sessID)
+	return ln
+}
+
+// addReverseTarget records the local target of a reverse forward requested on t
+func (t *tunnel) addReverseTarget(fwdID uint32, target string) {
+	t.mu.Lock()
+	t.reverse[fwdID] = target
+	t.mu.Unlock()
+}
+
+// reverseTarget returns the local target of a reverse forward, or "" if unknown
+func (t *tunnel) reverseTarget(fwdID uint32) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reverse[fwdID]
+}
+
+func (t *tunnel) removeReverseTarget(fwdID uint32) {
+	t.mu.Lock()
+	delete(t.reverse, fwdID)
+	t.mu.Unlock()
+}
+
+// addPending registers a connect waiting for its frameOpenResult
+func (t *tunnel) addPending(sessID uint32, pc *pendingConnect) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.pending[sessID] = pc
+	return true
+}
+
+// takePending removes and returns the pending connect for sessID, or nil if it was
+// already completed; whoever takes it owns replying to the client
+func (t *tunnel) takePending(sessID uint32) *pendingConnect {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pc, ok := t.pending[sessID]
+	if !ok {
+		return nil
+	}
+	delete(t.pending, sessID)
+	return pc
+}
+
+// session pipes one local connection through the tunnel: the SOCKS client on the
+// proxy side, the dialed target on the agent side. Data from the tunnel is queued
+// without blocking the tunnel reader; the peer's window keeps that queue bounded.
+type session struct {
+	id     uint32
+	tunnel *tunnel
+	conn   net.Conn
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	queue      [][]byte
+	queued     int  // bytes in queue
+	sendWindow int  // bytes we may still send to the peer
+	recvFIN    bool // peer sent frameHalfClose
+	sentFIN    bool
+	wroteDone  bool // peer's half-close was applied to conn
+	closed     bool
+}
+
+// start begins forwarding in both directions
+func (s *session) start() {
+	go s.readLocal()
+	go s.writeLocal()
+}
+
+// deliver queues payload from the tunnel for the local connection
+func (s *session) deliver(payload []byte) {
+	s.mu.Lock()
+	if s.recvFIN || s.closed {
+		s.mu.Unlock()
+		logger.Debug("session %08x received data after half-close, dropping", s.id)
+		return
+	}
+	if s.queued+len(payload) > initialWindow {
+		s.mu.Unlock()
+		logger.Error("session %08x peer exceeded its flow control window", s.id)
+		s.abort(true)
+		return
+	}
+	s.queue = append(s.queue, payload)
+	s.queued += len(payload)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// remoteHalfClose marks the end of data from the peer
+func (s *session) remoteHalfClose() {
+	s.mu.Lock()
+	s.recvFIN = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// addCredit extends the send window after the peer consumed data
+func (s *session) addCredit(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// readLocal forwards local connection data to the tunnel, never sending more than
+// the peer's window allows
+func (s *session) readLocal() {
+	buf := make([]byte, 4096)
+	for {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		limit := min(len(buf), s.sendWindow)
+		s.mu.Unlock()
+
+		n, err := s.conn.Read(buf[:limit])
+		if n > 0 {
+			s.mu.Lock()
+			s.sendWindow -= n
+			s.mu.Unlock()
+			logger.Debug("session %08x sending %d bytes to tunnel", s.id, n)
+			if werr := s.tunnel.send(frameData, s.id, buf[:n]); werr != nil {
+				logger.Error("session %08x tunnel write failed: %v", s.id, werr)
+				s.abort(false)
+				return
+			}
+		}
+		if err == io.EOF {
+			logger.Debug("session %08x local side finished sending", s.id)
+			if werr := s.tunnel.send(frameHalfClose, s.id, nil); werr != nil {
+				s.abort(false)
+				return
+			}
+			s.finishHalf(true)
+			return
+		}
+		if err != nil {
+			logger.Debug("session %08x local read failed: %v", s.id, err)
+			s.abort(true)
+			return
+		}
+	}
+}
+
+// writeLocal forwards queued tunnel data to the local connection and returns credit
+// to the peer as it is written
+func (s *session) writeLocal() {
+	consumed := 0
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.recvFIN && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			logger.Debug("session %08x peer finished sending", s.id)
+			if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+				s.finishHalf(false)
+			} else {
+				s.abort(true)
+			}
+			return
+		}
+		data := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.queued -= len(data)
+		s.mu.Unlock()
+
+		if _, err := s.conn.Write(data); err != nil {
+			logger.Debug("session %08x local write failed: %v", s.id, err)
+			s.abort(true)
+			return
+		}
+		// batch credit updates instead of acknowledging every frame
+		consumed += len(data)
+		if consumed >= windowUpdateThreshold {
+			credit := binary.BigEndian.AppendUint32(nil, uint32(consumed))
+			if err := s.tunnel.send(frameWindow, s.id, credit); err != nil {
+				s.abort(false)
+				return
+			}
+			consumed = 0
+		}
+	}
+}
+
+// finishHalf records one direction as finished and closes the session once both are
+func (s *session) finishHalf(sent bool) {
+	s.mu.Lock()
+	if sent {
+		s.sentFIN = true
+	} else {
+		s.wroteDone = true
+	}
+	both := s.sentFIN && s.wroteDone
+	s.mu.Unlock()
+	if both {
+		logger.Info("session %08x closed", s.id)
+		s.abort(false)
+	}
+}
+
+// abort closes the session immediately, notifying the peer with frameReset if asked
+func (s *session) abort(notify bool) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.tunnel.removeSession(s.id)
+	s.conn.Close()
+	if notify {
+		logger.Info("session %08x aborted", s.id)
+		s.tunnel.send(frameReset, s.id, nil)
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tunnelPair returns two connected tunnels with their read loops running
+func tunnelPair(t *testing.T) (*tunnel, *tunnel) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	a, b := newTunnel(c1), newTunnel(c2)
+	ignore := func(*tunnel, frame) {}
+	go a.readLoop(ignore)
+	go b.readLoop(ignore)
+	t.Cleanup(func() {
+		a.close()
+		b.close()
+	})
+	return a, b
+}
+
+// sessionPair starts session id on both tunnels and returns the far ends of their
+// local connections
+func sessionPair(t *testing.T, a, b *tunnel, id uint32) (net.Conn, net.Conn) {
+	t.Helper()
+	aLocal, aFar := net.Pipe()
+	bLocal, bFar := net.Pipe()
+	sa, sb := a.addSession(id, aLocal), b.addSession(id, bLocal)
+	if sa == nil || sb == nil {
+		t.Fatal("addSession on an open tunnel returned nil")
+	}
+	sa.start()
+	sb.start()
+	t.Cleanup(func() {
+		aFar.Close()
+		bFar.Close()
+	})
+	return aFar, bFar
+}
+
+func TestSessionWindowOverflowAborts(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tn := newTunnel(c1)
+	defer tn.close()
+	local, far := net.Pipe()
+	defer far.Close()
+	s := tn.addSession(5, local)
+
+	resets := make(chan frame, 1)
+	go func() {
+		for {
+			f, err := readFrame(c2)
+			if err != nil {
+				return
+			}
+			if f.typ == frameReset {
+				resets <- f
+			}
+		}
+	}()
+
+	// the session is not started, so nothing drains the queue
+	chunk := make([]byte, initialWindow/4)
+	for range 4 {
+		s.deliver(chunk)
+	}
+	if tn.session(5) == nil {
+		t.Fatal("session aborted while the peer stayed within its window")
+	}
+	s.deliver([]byte{0})
+	select {
+	case f := <-resets:
+		if f.sessID != 5 {
+			t.Fatalf("reset for session %08x, want 00000005", f.sessID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reset sent after the peer exceeded its window")
+	}
+	if tn.session(5) != nil {
+		t.Fatal("session still registered after exceeding its window")
+	}
+}
+
+func TestStalledSessionDoesNotBlockOthers(t *testing.T) {
+	a, b := tunnelPair(t)
+	stalledIn, _ := sessionPair(t, a, b, 1) // nobody reads session 1's far end on b
+	liveIn, liveOut := sessionPair(t, a, b, 2)
+
+	// fill session 1 beyond its window; the writer blocks once the window is spent
+	go stalledIn.Write(make([]byte, 2*initialWindow))
+	time.Sleep(100 * time.Millisecond)
+
+	want := bytes.Repeat([]byte("live"), 1024)
+	go liveIn.Write(want)
+	got := make([]byte, len(want))
+	liveOut.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(liveOut, got); err != nil {
+		t.Fatalf("session 2 blocked behind stalled session 1: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("session 2 data corrupted")
+	}
+	if a.session(1) == nil || b.session(1) == nil {
+		t.Fatal("stalled session was aborted instead of being flow controlled")
+	}
+}
@@ -0,0 +1,462 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lonepie/reverse-soxy/internal/logger"
+)
+
+// udpIdleTimeout is how long an agent keeps a UDP association without traffic
+const udpIdleTimeout = 2 * time.Minute
+
+// udpRelay is the proxy end of a SOCKS5 UDP ASSOCIATE: a local UDP socket the client
+// sends encapsulated datagrams to, tied to the client's TCP control connection.
+// Each datagram is routed by its destination, so one relay may open an association
+// on several agents, each when the first datagram for it arrives, and a socket of
+// its own for destinations routed direct.
+type udpRelay struct {
+	conn     *net.UDPConn
+	control  net.Conn
+	clientIP net.IP
+	agent    string // picked by the client's username
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr       // learned from the client's first datagram
+	legs       map[string]*udpLeg // by agent or group name, "" for the default agent
+	direct     *udpDirect
+	closed     bool
+	closeOnce  sync.Once
+}
+
+// socksUDPAssociate relays the client's datagrams until its control connection
+// closes. agent, if set, takes every datagram the routing table does not reject.
+func socksUDPAssociate(client net.Conn, agent string) {
+	localHost, _, _ := net.SplitHostPort(client.LocalAddr().String())
+	clientHost, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(localHost)})
+	if err != nil {
+		logger.Error("UDP relay listen failed: %v", err)
+		client.Write(socksReply(socksRepGeneralFailure, nil))
+		client.Close()
+		return
+	}
+	u := &udpRelay{
+		conn:     conn,
+		control:  client,
+		clientIP: net.ParseIP(clientHost),
+		agent:    agent,
+		legs:     make(map[string]*udpLeg),
+	}
+	if _, err := client.Write(socksReply(socksRepSucceeded, encodeSOCKSAddr(conn.LocalAddr()))); err != nil {
+		conn.Close()
+		client.Close()
+		return
+	}
+	logger.Info("UDP relay for %v listening on %v", client.RemoteAddr(), conn.LocalAddr())
+	go u.readClient()
+	// the association lasts as long as the control connection (RFC 1928, section 7)
+	io.Copy(io.Discard, client)
+	u.close()
+}
+
+// readClient routes the client's datagrams by destination. Each one is
+// RSV (2) | FRAG (1) | ATYP | DST.ADDR | DST.PORT | DATA; fragments are dropped.
+func (u *udpRelay) readClient() {
+	buf := make([]byte, maxFramePayload)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			u.close()
+			return
+		}
+		if !addr.IP.Equal(u.clientIP) {
+			logger.Debug("UDP relay %v dropping datagram from foreign address %v", u.conn.LocalAddr(), addr)
+			continue
+		}
+		if n < 4 || buf[2] != 0x00 {
+			logger.Debug("UDP relay %v dropping short or fragmented datagram", u.conn.LocalAddr())
+			continue
+		}
+		target, _, err := parseSOCKSAddr(buf[3:n])
+		if err != nil {
+			logger.Debug("UDP relay %v dropping datagram: %v", u.conn.LocalAddr(), err)
+			continue
+		}
+		u.mu.Lock()
+		u.clientAddr = addr
+		u.mu.Unlock()
+		payload := append([]byte(nil), buf[3:n]...)
+		switch r := routeForUser(target, u.agent); r.Action {
+		case "reject":
+			logger.Debug("Route %q rejects UDP datagram to %s", r.Match, target)
+		case "direct":
+			if d := u.directSocket(); d != nil {
+				d.send(payload)
+			}
+		default:
+			if l := u.leg(r.Agent); l != nil {
+				l.send(payload)
+			}
+		}
+	}
+}
+
+// leg returns the relay's association on agent, starting one if there is none
+func (u *udpRelay) leg(agent string) *udpLeg {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return nil
+	}
+	l := u.legs[agent]
+	if l == nil {
+		l = &udpLeg{relay: u, agent: agent, queue: make(chan []byte, 64), done: make(chan struct{})}
+		u.legs[agent] = l
+		go l.run()
+	}
+	return l
+}
+
+// directSocket returns the relay's socket for direct destinations, opening it if
+// there is none
+func (u *udpRelay) directSocket() *udpDirect {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return nil
+	}
+	if u.direct == nil {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			logger.Error("UDP relay %v direct listen failed: %v", u.conn.LocalAddr(), err)
+			return nil
+		}
+		u.direct = &udpDirect{relay: u, conn: conn, queue: make(chan []byte, 64), done: make(chan struct{})}
+		logger.Info("UDP relay %v sending direct from %v", u.conn.LocalAddr(), conn.LocalAddr())
+		go u.direct.readTargets()
+		go u.direct.writeTargets()
+	}
+	return u.direct
+}
+
+// dropLeg forgets l, so the next datagram for its agent opens a new association
+func (u *udpRelay) dropLeg(l *udpLeg) {
+	u.mu.Lock()
+	if u.legs[l.agent] == l {
+		delete(u.legs, l.agent)
+	}
+	u.mu.Unlock()
+}
+
+// toClient sends a reply datagram, ATYP | ADDR | PORT | DATA, back to the client
+func (u *udpRelay) toClient(payload []byte) {
+	u.mu.Lock()
+	addr := u.clientAddr
+	u.mu.Unlock()
+	if addr == nil {
+		return
+	}
+	if _, err := u.conn.WriteToUDP(append([]byte{0x00, 0x00, 0x00}, payload...), addr); err != nil {
+		logger.Debug("UDP relay %v write to client failed: %v", u.conn.LocalAddr(), err)
+	}
+}
+
+// close ends the relay and every association it opened
+func (u *udpRelay) close() {
+	u.closeOnce.Do(func() {
+		logger.Info("UDP relay %v closed", u.conn.LocalAddr())
+		u.conn.Close()
+		u.control.Close()
+		u.mu.Lock()
+		u.closed = true
+		legs, direct := u.legs, u.direct
+		u.legs = nil
+		u.mu.Unlock()
+		for _, l := range legs {
+			l.stop(true)
+		}
+		if direct != nil {
+			close(direct.done)
+			direct.conn.Close()
+		}
+	})
+}
+
+// udpLeg is a relay's UDP association on one agent
+type udpLeg struct {
+	relay    *udpRelay
+	agent    string
+	queue    chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu sync.Mutex
+	t  *tunnel
+	id uint32
+}
+
+// send queues a datagram for the agent, dropping it if the queue is full
+func (l *udpLeg) send(payload []byte) {
+	select {
+	case l.queue <- payload:
+	default:
+		logger.Debug("UDP relay %v queue for agent %q full, dropping datagram", l.relay.conn.LocalAddr(), l.agent)
+	}
+}
+
+// run opens the association on the agent and forwards queued datagrams to it
+func (l *udpLeg) run() {
+	t, sessID, rep := openThroughTunnel(l.agent, openUDPAssociate, "", func(t *tunnel, sessID uint32, rep byte, _ []byte) byte {
+		if rep == socksRepSucceeded {
+			l.mu.Lock()
+			l.t, l.id = t, sessID
+			l.mu.Unlock()
+			if !t.addDatagramSession(sessID, l) {
+				rep = socksRepGeneralFailure
+			}
+		}
+		return rep
+	})
+	if rep != socksRepSucceeded {
+		logger.Error("UDP association %08x failed, reply code %#02x", sessID, rep)
+		l.relay.dropLeg(l)
+		l.stop(false)
+		return
+	}
+	select {
+	case <-l.done:
+		// the relay closed while the agent was opening the association
+		t.removeDatagramSession(sessID)
+		t.send(frameReset, sessID, nil)
+		return
+	default:
+	}
+	logger.Info("UDP association %08x for %v via %v", sessID, l.relay.conn.LocalAddr(), t.conn.RemoteAddr())
+	for {
+		select {
+		case payload := <-l.queue:
+			if err := t.send(frameDatagram, sessID, payload); err != nil {
+				l.closeDatagram()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// deliverDatagram sends a reply datagram from the agent back to the client
+func (l *udpLeg) deliverDatagram(payload []byte) {
+	l.relay.toClient(payload)
+}
+
+// closeDatagram drops an association the agent or tunnel ended; the relay opens a
+// new one for the next datagram
+func (l *udpLeg) closeDatagram() {
+	l.relay.dropLeg(l)
+	l.stop(false)
+}
+
+// stop ends the association, telling the agent to drop it if notify is set
+func (l *udpLeg) stop(notify bool) {
+	l.stopOnce.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		t, id := l.t, l.id
+		l.mu.Unlock()
+		if t == nil {
+			return
+		}
+		logger.Info("UDP association %08x closed", id)
+		t.removeDatagramSession(id)
+		if notify {
+			t.send(frameReset, id, nil)
+		}
+	})
+}
+
+// udpDirect sends a relay's datagrams for direct destinations from the proxy's
+// own UDP socket
+type udpDirect struct {
+	relay *udpRelay
+	conn  *net.UDPConn
+	queue chan []byte
+	done  chan struct{}
+}
+
+// send queues a datagram, dropping it if the queue is full
+func (d *udpDirect) send(payload []byte) {
+	select {
+	case d.queue <- payload:
+	default:
+		logger.Debug("UDP relay %v direct queue full, dropping datagram", d.relay.conn.LocalAddr())
+	}
+}
+
+// writeTargets resolves each queued datagram's destination and sends it
+func (d *udpDirect) writeTargets() {
+	for {
+		select {
+		case payload := <-d.queue:
+			target, n, err := parseSOCKSAddr(payload)
+			if err != nil {
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				logger.Debug("UDP relay %v cannot resolve %s: %v", d.relay.conn.LocalAddr(), target, err)
+				continue
+			}
+			if _, err := d.conn.WriteToUDP(payload[n:], addr); err != nil {
+				logger.Debug("UDP relay %v write to %v failed: %v", d.relay.conn.LocalAddr(), addr, err)
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// readTargets returns datagrams from direct targets to the client
+func (d *udpDirect) readTargets() {
+	buf := make([]byte, maxFramePayload)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		d.relay.toClient(append(encodeSOCKSAddr(addr), buf[:n]...))
+	}
+}
+
+// udpAssociation is the agent end of a UDP association: one UDP socket per
+// association, expired after udpIdleTimeout without traffic
+type udpAssociation struct {
+	t          *tunnel
+	id         uint32
+	conn       *net.UDPConn
+	outgoing   chan []byte
+	done       chan struct{}
+	lastActive atomic.Int64
+	closeOnce  sync.Once
+}
+
+// openUDPAssociation opens a UDP socket for the proxy and reports its address
+func openUDPAssociation(t *tunnel, sessID uint32) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.Error("UDP association %08x listen failed: %v", sessID, err)
+		t.send(frameOpenResult, sessID, append([]byte{socksRepGeneralFailure}, encodeSOCKSAddr(nil)...))
+		return
+	}
+	a := &udpAssociation{
+		t:        t,
+		id:       sessID,
+		conn:     conn,
+		outgoing: make(chan []byte, 64),
+		done:     make(chan struct{}),
+	}
+	a.lastActive.Store(time.Now().UnixNano())
+	if !t.addDatagramSession(sessID, a) {
+		conn.Close()
+		return
+	}
+	result := append([]byte{socksRepSucceeded}, encodeSOCKSAddr(conn.LocalAddr())...)
+	if err := t.send(frameOpenResult, sessID, result); err != nil {
+		a.close(false)
+		return
+	}
+	logger.Info("UDP association %08x opened on %v", sessID, conn.LocalAddr())
+	go a.readTargets()
+	go a.writeTargets()
+	go a.expire()
+}
+
+// deliverDatagram queues a datagram for its target, dropping it if the queue is full
+func (a *udpAssociation) deliverDatagram(payload []byte) {
+	a.lastActive.Store(time.Now().UnixNano())
+	select {
+	case a.outgoing <- payload:
+	default:
+		logger.Debug("UDP association %08x queue full, dropping datagram", a.id)
+	}
+}
+
+// writeTargets resolves each queued datagram's destination and sends it
+func (a *udpAssociation) writeTargets() {
+	for {
+		select {
+		case payload := <-a.outgoing:
+			target, n, err := parseSOCKSAddr(payload)
+			if err != nil {
+				logger.Debug("UDP association %08x dropping datagram: %v", a.id, err)
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				logger.Debug("UDP association %08x cannot resolve %s: %v", a.id, target, err)
+				continue
+			}
+			if _, err := a.conn.WriteToUDP(payload[n:], addr); err != nil {
+				logger.Debug("UDP association %08x write to %v failed: %v", a.id, addr, err)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// readTargets returns datagrams from targets to the proxy, tagged with their source
+func (a *udpAssociation) readTargets() {
+	buf := make([]byte, maxFramePayload-1-net.IPv6len-2)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			a.close(true)
+			return
+		}
+		a.lastActive.Store(time.Now().UnixNano())
+		payload := append(encodeSOCKSAddr(addr), buf[:n]...)
+		if err := a.t.send(frameDatagram, a.id, payload); err != nil {
+			a.close(false)
+			return
+		}
+	}
+}
+
+// expire closes the association once it has been idle for udpIdleTimeout
+func (a *udpAssociation) expire() {
+	ticker := time.NewTicker(udpIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, a.lastActive.Load())) > udpIdleTimeout {
+				logger.Info("UDP association %08x idle, closing", a.id)
+				a.close(true)
+				return
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+func (a *udpAssociation) closeDatagram() {
+	a.close(false)
+}
+
+// close releases the socket, telling the proxy to drop the association if notify is set
+func (a *udpAssociation) close(notify bool) {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.conn.Close()
+		a.t.removeDatagramSession(a.id)
+		if notify {
+			a.t.send(frameReset, a.id, nil)
+		}
+	})
+}